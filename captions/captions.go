@@ -0,0 +1,212 @@
+// Package captions renders timed text as WebVTT and SubRip (SRT) caption
+// files.
+package captions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// LineWidth is the most characters put on one caption line, the usual
+	// broadcast guideline.
+	LineWidth = 42
+	// MaxLines is the most lines shown in one cue.  Longer text is split
+	// into several cues.
+	MaxLines = 2
+	// minCueDuration keeps every cue on screen for at least a moment, even
+	// when the recognizer gave it no length.
+	minCueDuration = 500 * time.Millisecond
+)
+
+// Cue is a piece of text shown from Start to End.
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// WriteVTT writes cues as a WebVTT file.  Text is escaped so it is always
+// shown literally, never read as markup.
+func WriteVTT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n")
+	for i, cue := range Layout(cues) {
+		fmt.Fprintf(bw, "\n%d\n%s --> %s\n", i+1, vttTime(cue.Start), vttTime(cue.End))
+		bw.WriteString(escapeVTT(cue.Text))
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+// WriteSRT writes cues as a SubRip file.
+func WriteSRT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	for i, cue := range Layout(cues) {
+		if i > 0 {
+			bw.WriteString("\r\n")
+		}
+		fmt.Fprintf(bw, "%d\r\n%s --> %s\r\n", i+1, srtTime(cue.Start), srtTime(cue.End))
+		bw.WriteString(strings.Replace(escapeSRT(cue.Text), "\n", "\r\n", -1))
+		bw.WriteString("\r\n")
+	}
+	return bw.Flush()
+}
+
+// Layout prepares cues for display: it drops empty ones, puts them in time
+// order, keeps them from overlapping, wraps their text to LineWidth and
+// splits any cue longer than MaxLines into several, sharing out its time by
+// length of text.  The Text of every returned cue is its lines joined by
+// "\n".
+func Layout(cues []Cue) []Cue {
+	clean := make([]Cue, 0, len(cues))
+	for _, cue := range cues {
+		cue.Text = strings.Join(strings.Fields(cue.Text), " ")
+		if cue.Text == "" {
+			continue
+		}
+		if cue.Start < 0 {
+			cue.Start = 0
+		}
+		if cue.End < cue.Start+minCueDuration {
+			cue.End = cue.Start + minCueDuration
+		}
+		clean = append(clean, cue)
+	}
+	sort.SliceStable(clean, func(i, j int) bool {
+		return clean[i].Start < clean[j].Start
+	})
+
+	// A cue ends no later than the next one starts, so only one is on
+	// screen at a time
+	for i := 0; i+1 < len(clean); i++ {
+		if next := clean[i+1].Start; clean[i].End > next && next > clean[i].Start {
+			clean[i].End = next
+		}
+	}
+
+	out := make([]Cue, 0, len(clean))
+	for _, cue := range clean {
+		out = append(out, split(cue)...)
+	}
+	return out
+}
+
+// split wraps a cue's text and breaks it into cues of at most MaxLines lines.
+func split(cue Cue) []Cue {
+	lines := Wrap(cue.Text, LineWidth)
+	if len(lines) <= MaxLines {
+		cue.Text = strings.Join(lines, "\n")
+		return []Cue{cue}
+	}
+
+	total := 0
+	for _, line := range lines {
+		total += utf8.RuneCountInString(line)
+	}
+	length := cue.End - cue.Start
+
+	cues := []Cue{}
+	start := cue.Start
+	done := 0
+	for i := 0; i < len(lines); i += MaxLines {
+		j := i + MaxLines
+		if j > len(lines) {
+			j = len(lines)
+		}
+		for _, line := range lines[i:j] {
+			done += utf8.RuneCountInString(line)
+		}
+		end := cue.Start + time.Duration(int64(length)*int64(done)/int64(total))
+		if j == len(lines) {
+			end = cue.End
+		}
+		cues = append(cues, Cue{
+			Start: start,
+			End:   end,
+			Text:  strings.Join(lines[i:j], "\n"),
+		})
+		start = end
+	}
+	return cues
+}
+
+// Wrap breaks text into lines of at most width characters, breaking between
+// words.  A single word longer than width is broken wherever it has to be.
+// Widths below one are treated as one.
+func Wrap(text string, width int) []string {
+	if width < 1 {
+		width = 1
+	}
+	lines := []string{}
+	line := ""
+	for _, word := range strings.Fields(text) {
+		for utf8.RuneCountInString(word) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			r := []rune(word)
+			lines = append(lines, string(r[:width]))
+			word = string(r[width:])
+		}
+		switch {
+		case line == "":
+			line = word
+		case utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) <= width:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// escapeVTT escapes the characters WebVTT treats as markup.  Escaping ">"
+// also means the text can never contain "-->".
+func escapeVTT(s string) string {
+	return vttEscaper.Replace(s)
+}
+
+var srtEscaper = strings.NewReplacer("<", "‹", ">", "›")
+
+// escapeSRT keeps text from being read as markup or a timing line.  SRT has
+// no escape sequences and players treat "<" as the start of a formatting tag,
+// so angle brackets are swapped for look-alike characters.
+func escapeSRT(s string) string {
+	return srtEscaper.Replace(s)
+}
+
+// vttTime formats d as hh:mm:ss.ttt.
+func vttTime(d time.Duration) string {
+	h, m, s, ms := clock(d)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, s, ms)
+}
+
+// srtTime formats d as hh:mm:ss,ttt.
+func srtTime(d time.Duration) string {
+	h, m, s, ms := clock(d)
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", h, m, s, ms)
+}
+
+func clock(d time.Duration) (h, m, s, ms int64) {
+	total := int64(d / time.Millisecond)
+	ms = total % 1000
+	total /= 1000
+	s = total % 60
+	total /= 60
+	m = total % 60
+	h = total / 60
+	return
+}
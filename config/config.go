@@ -6,6 +6,10 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
 )
 
 type PostgresConfig struct {
@@ -38,20 +42,104 @@ type Config struct {
 	Port     string         `json:"port"`
 	Env      string         `json:"env"`
 	Pepper   string         `json:"pepper"`
+	HMACKey  string         `json:"hmacKey"`
 	Database PostgresConfig `json:"database"`
 
 	PubKeyPath            string `json:"pubKeyPath"`
 	PrivKeyPath           string `json:"privKeyPath"`
 	PassResetSecretString string `json:"passResetSecret"`
+	// ResetURL is prefixed to the token in password reset emails, e.g. a
+	// deep link into the iPad app.
+	ResetURL string        `json:"resetURL"`
+	Mail     MailConfig    `json:"mail"`
+	Search   SearchConfig  `json:"search"`
+	Storage  StorageConfig `json:"storage"`
+	Upload   UploadConfig  `json:"upload"`
 
-	VerifyKey []byte
-	SignKey   []byte
+	VerifyKey       []byte
+	SignKey         []byte
+	PassResetSecret []byte
+}
+
+// MailConfig picks how outgoing email is delivered.  Sender is one of "file",
+// "smtp" or "log"; "log" writes reset links to the server log, so it is only
+// for development and has to be asked for.
+type MailConfig struct {
+	Sender   string `json:"sender"`
+	From     string `json:"from"`
+	Dir      string `json:"dir"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SearchConfig tunes topic search.  SimilarityThreshold is how close, from 0
+// to 1, a topic must be to a keyword to match it; lower values forgive more
+// typos but find more unrelated topics.  Left out, pg_trgm's default of 0.3
+// is used.
+type SearchConfig struct {
+	SimilarityThreshold float64 `json:"similarityThreshold"`
+}
+
+// StorageConfig picks where lecture media is kept.  Backend is one of "gcs"
+// (the default), "s3" or "local".  Bucket, AccessKey and SecretKey apply to
+// both cloud backends, Endpoint, Region, PathStyle and PublicURL to S3, and
+// Dir, PublicURL and SigningKey to local storage.  A GCS store with no
+// bucket takes the bucket from each object key, as the pipeline's gs://
+// links do.  LinkTTL is how long signed playback links last, as a duration
+// like "1h"; left out, an hour.
+//
+// Public says anyone can read the cloud buckets.  Only objects under a
+// class's upload prefix are ever signed, so lectures the pipeline left
+// elsewhere can only be played from a public store; in a private one they
+// must be moved under their class's prefix first.  A private cloud store
+// needs AccessKey and SecretKey.
+type StorageConfig struct {
+	Backend   string `json:"backend"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	PathStyle bool   `json:"pathStyle"`
+	Public    bool   `json:"public"`
+	PublicURL string `json:"publicURL"`
+	Dir       string `json:"dir"`
+
+	SigningKey string `json:"signingKey"`
+	LinkTTL    string `json:"linkTTL"`
+
+	TTL time.Duration `json:"-"`
+}
+
+// UploadConfig limits recordings uploaded straight to the server.  Chunks of
+// resumable uploads are kept in Dir until complete, the system's temporary
+// directory if left out.  MaxSizeMB and Types default to 4 GiB and common
+// audio and video types.  KeyPrefix starts the object key of every upload,
+// "uploads" if left out; with a GCS store that has no bucket it must be set,
+// and start with the bucket to upload to.  ExpireAfter is how long an
+// upload can go without a chunk before it is thrown away, as a duration
+// like "24h"; left out, a day.
+type UploadConfig struct {
+	Dir         string   `json:"dir"`
+	MaxSizeMB   int64    `json:"maxSizeMB"`
+	Types       []string `json:"types"`
+	KeyPrefix   string   `json:"keyPrefix"`
+	ExpireAfter string   `json:"expireAfter"`
+
+	Expiry time.Duration `json:"-"`
 }
 
 func LoadConfig() *Config {
 	c := readJSONConfig()
 	c.checkProd()
 	c.loadJWTKeys()
+	c.loadPassReset()
+	c.loadMail()
+	c.loadSearch()
+	c.loadStorage()
+	c.loadUpload()
 
 	fmt.Println("Successfully Loaded Config File")
 	return c
@@ -95,7 +183,110 @@ func (c *Config) loadJWTKeys() {
 	}
 }
 
-// func (c *Config) loadPassReset() {
-// 	// Load PasswordReset Secret
-// 	c.PassResetSecret = []byte(c.PassResetSecretString)
-// }
+func (c *Config) loadPassReset() {
+	// Load PasswordReset Secret
+	if c.PassResetSecretString == "" {
+		log.Fatal("passResetSecret must be set in config")
+	}
+	c.PassResetSecret = []byte(c.PassResetSecretString)
+}
+
+func (c *Config) loadMail() {
+	switch c.Mail.Sender {
+	case "log":
+		log.Println("Warning: mail is written to the log, including password reset links")
+	case "file":
+		if c.Mail.Dir == "" {
+			log.Fatal("mail.dir must be set for the file sender")
+		}
+	case "smtp":
+		if c.Mail.Host == "" || c.Mail.Port == "" || c.Mail.From == "" {
+			log.Fatal("mail.host, mail.port and mail.from must be set for smtp")
+		}
+	default:
+		log.Fatal("mail.sender must be file, smtp or log")
+	}
+}
+
+// A threshold of 0 is left for the video service to replace with its default
+func (c *Config) loadSearch() {
+	if c.Search.SimilarityThreshold < 0 || c.Search.SimilarityThreshold > 1 {
+		log.Fatal("search.similarityThreshold must be between 0 and 1")
+	}
+}
+
+func (c *Config) loadStorage() {
+	switch c.Storage.Backend {
+	case "", "gcs":
+		c.checkStorageKeys()
+	case "s3":
+		if c.Storage.Endpoint == "" || c.Storage.Bucket == "" {
+			log.Fatal("storage.endpoint and storage.bucket must be set for s3")
+		}
+		c.checkStorageKeys()
+	case "local":
+		if c.Storage.Dir == "" || c.Storage.PublicURL == "" || c.Storage.SigningKey == "" {
+			log.Fatal("storage.dir, storage.publicURL and storage.signingKey must be set for local storage")
+		}
+	default:
+		log.Fatal("storage.backend must be gcs, s3 or local")
+	}
+
+	c.Storage.TTL = time.Hour
+	if c.Storage.LinkTTL != "" {
+		ttl, err := time.ParseDuration(c.Storage.LinkTTL)
+		if err != nil || ttl <= 0 || ttl > storage.MaxSignedURLTTL {
+			log.Fatal("storage.linkTTL must be a duration of at most 7 days, like \"1h\"")
+		}
+		c.Storage.TTL = ttl
+	}
+}
+
+// checkStorageKeys makes sure a cloud store can hand out links: a private
+// one needs a key to sign them with.  A public one without a key is warned
+// about, since every link handed out is then a plain one that never expires.
+func (c *Config) checkStorageKeys() {
+	if (c.Storage.AccessKey == "") != (c.Storage.SecretKey == "") {
+		log.Fatal("storage.accessKey and storage.secretKey must be set together")
+	}
+	public := c.Storage.Public || c.Storage.PublicURL != "" && c.Storage.Backend == "s3"
+	if c.Storage.AccessKey == "" && !public {
+		log.Fatal("storage.accessKey and storage.secretKey must be set unless storage.public is")
+	}
+	if c.Storage.AccessKey == "" {
+		log.Println("Warning: storage.accessKey is not set, so links to lecture media are not signed and the buckets must be public")
+	}
+}
+
+func (c *Config) loadUpload() {
+	if c.Upload.MaxSizeMB < 0 {
+		log.Fatal("upload.maxSizeMB must not be negative")
+	}
+	if c.Upload.Dir == "" {
+		c.Upload.Dir = filepath.Join(os.TempDir(), "intellicast-uploads")
+	}
+	if err := os.MkdirAll(c.Upload.Dir, 0700); err != nil {
+		log.Fatal("Error creating upload directory:", err)
+	}
+	if c.Upload.KeyPrefix == "" {
+		// A bucket-less GCS store would take the default for a bucket name
+		if (c.Storage.Backend == "" || c.Storage.Backend == "gcs") && c.Storage.Bucket == "" {
+			log.Fatal("upload.keyPrefix must start with the bucket to upload to when storage.bucket is not set for gcs")
+		}
+		c.Upload.KeyPrefix = "uploads"
+	}
+	prefix, err := storage.CleanKey(c.Upload.KeyPrefix)
+	if err != nil {
+		log.Fatal("upload.keyPrefix must be a relative path like \"uploads\"")
+	}
+	c.Upload.KeyPrefix = prefix
+
+	c.Upload.Expiry = 24 * time.Hour
+	if c.Upload.ExpireAfter != "" {
+		expiry, err := time.ParseDuration(c.Upload.ExpireAfter)
+		if err != nil || expiry <= 0 {
+			log.Fatal("upload.expireAfter must be a positive duration, like \"24h\"")
+		}
+		c.Upload.Expiry = expiry
+	}
+}
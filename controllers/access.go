@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/models"
+)
+
+// classAccess answers who may see and change a class.  It is embedded in
+// every controller that serves something belonging to a class.
+type classAccess struct {
+	cs models.ClassService
+	es models.EnrollmentService
+}
+
+// canView reports whether the user in claims may see the lectures of a class.
+func (a *classAccess) canView(claims *Claims, classID uint) (bool, error) {
+	if claims.UserType == models.RoleAdmin {
+		return true, nil
+	}
+	_, err := a.es.ByUserAndClass(claims.UserID, classID)
+	switch err {
+	case nil:
+		return true, nil
+	case models.ErrNotEnrolled:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// viewableClasses returns every class the user in claims may see the
+// lectures of: all live classes for admins, otherwise the classes they are
+// enrolled in.
+func (a *classAccess) viewableClasses(claims *Claims) ([]models.Class, error) {
+	if claims.UserType == models.RoleAdmin {
+		return a.cs.GetAll()
+	}
+	return a.es.ClassesByUser(claims.UserID)
+}
+
+// authorizeView writes an error response and returns false when the current
+// user may not see the class.
+func (a *classAccess) authorizeView(w http.ResponseWriter, r *http.Request, classID uint) bool {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	ok, err := a.canView(claims, classID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "You must be enrolled in this class", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// canEdit reports whether the user in claims may change a class and its
+// lectures: its owner, its co-instructors and admins.
+func (a *classAccess) canEdit(claims *Claims, class *models.Class) (bool, error) {
+	if a.canManage(claims, class) {
+		return true, nil
+	}
+	enrollment, err := a.es.ByUserAndClass(claims.UserID, class.ID)
+	switch err {
+	case nil:
+		return enrollment.Role == models.EnrollmentProfessor, nil
+	case models.ErrNotEnrolled:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// canManage reports whether the user in claims may delete a class or change
+// who teaches it: only its owner and admins.
+func (a *classAccess) canManage(claims *Claims, class *models.Class) bool {
+	if claims.UserType == models.RoleAdmin {
+		return true
+	}
+	return class.OwnerID != 0 && class.OwnerID == claims.UserID
+}
+
+// authorizeEdit writes an error response and returns false when the current
+// user may not change the class.
+func (a *classAccess) authorizeEdit(w http.ResponseWriter, r *http.Request, class *models.Class) bool {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	ok, err := a.canEdit(claims, class)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "Only instructors of this class can change it", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeManage writes an error response and returns false when the
+// current user does not own the class.
+func (a *classAccess) authorizeManage(w http.ResponseWriter, r *http.Request, class *models.Class) bool {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if !a.canManage(claims, class) {
+		http.Error(w, "Only the owner of this class can do that", http.StatusForbidden)
+		return false
+	}
+	return true
+}
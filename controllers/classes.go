@@ -1,26 +1,43 @@
 package controllers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/TerrenceHo/CalHacks4-Backend/models"
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
 	"github.com/gorilla/mux"
 )
 
-func NewClasses(classes models.ClassService, videos models.VideoService) *Classes {
+func NewClasses(classes models.ClassService, enrollments models.EnrollmentService, videos models.VideoService, transcripts models.TranscriptService, occurrences models.TopicOccurrenceService, topics models.ClassTopicService, store storage.BlobStore, ttl time.Duration, keyPrefix string) *Classes {
 	return &Classes{
-		cs: classes,
-		vs: videos,
+		classAccess: classAccess{
+			cs: classes,
+			es: enrollments,
+		},
+		vs:    videos,
+		ts:    transcripts,
+		tos:   occurrences,
+		cts:   topics,
+		media: media{store, ttl, keyPrefix},
 	}
 }
 
 type Classes struct {
-	cs models.ClassService
-	vs models.VideoService
+	classAccess
+	media
+	vs  models.VideoService
+	ts  models.TranscriptService
+	tos models.TopicOccurrenceService
+	cts models.ClassTopicService
 }
 
 func (c *Classes) Create(w http.ResponseWriter, r *http.Request) {
@@ -30,12 +47,19 @@ func (c *Classes) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	claims, _ := ClaimsFromContext(r.Context())
 	class := models.Class{
+		OwnerID:     claims.UserID,
 		Name:        form.Name,
+		Code:        form.Code,
 		Description: form.Description,
 	}
 
 	if err := c.cs.CreateClass(&class); err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -48,6 +72,7 @@ func (c *Classes) Create(w http.ResponseWriter, r *http.Request) {
 
 type ClassesCreateForm struct {
 	Name        string `json:"Name,omitempty"`
+	Code        string `json:"Code,omitempty"`
 	Description string `json:"Description,omitempty"`
 }
 
@@ -63,28 +88,55 @@ func (c *Classes) GetAllClasses(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Sends back the lectures of a class.  Only users enrolled in the class, and
+// admins, can see them.  Lectures still pending processing are only listed
+// for instructors of the class.  The list can be narrowed and ordered with
+// the query parameters read by videoListOptions.
 func (c *Classes) GetClass(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseUint(vars["id"], 10, 32)
+	id, err := classIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	class, err := c.cs.GetClassByID(uint(id))
+	class, err := c.cs.GetClassByID(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	videos, err := c.vs.GetAll(class.ID)
+	if !c.authorizeView(w, r, class.ID) {
+		return
+	}
+	opts, err := videoListOptions(r.URL.Query())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	for i := 0; i < len(videos); i++ {
-		if len(videos[i].Topics) == 0 {
-			videos = append(videos[:i], videos[i+1:]...)
-			i--
+	videos, err := c.vs.ByClass(class.ID, opts)
+	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	claims, _ := ClaimsFromContext(r.Context())
+	canEdit, err := c.canEdit(claims, class)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !canEdit {
+		for i := 0; i < len(videos); i++ {
+			if videos[i].Status == models.VideoStatusPending {
+				videos = append(videos[:i], videos[i+1:]...)
+				i--
+			}
 		}
 	}
 	for i := 0; i < len(videos); i++ {
-		videos[i].URL = strings.Replace(videos[i].URL, "gs://", "https://storage.googleapis.com/", 1)
+		c.signVideo(&videos[i])
 	}
 	if err := json.NewEncoder(w).Encode(&videos); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -103,26 +155,83 @@ func (c *Classes) Upload(w http.ResponseWriter, r *http.Request) {
 	uploads := form.Videos
 	class_name := form.ClassName
 
+	class, err := c.cs.GetClassByName(class_name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !c.authorizeEdit(w, r, class) {
+		return
+	}
+
+	// Everything in the batch is checked before anything is saved, so a bad
+	// entry cannot leave the ones before it behind
+	videos := make([]models.Video, len(uploads))
+	occurrences := make([][]models.TopicOccurrence, len(uploads))
+	segments := make([][]models.TranscriptSegment, len(uploads))
 	for i := 0; i < len(uploads); i++ {
 		Video_URL := strings.Replace(uploads[i].Audio_URL, ".wav", ".mp4", 1)
-		class, err := c.cs.GetClassByName(class_name)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
 
-		video := models.Video{
+		videos[i] = models.Video{
 			ClassID:           class.ID,
 			URL:               Video_URL,
-			Topics:            uploads[i].Topics,
+			Title:             uploads[i].Title,
+			Description:       uploads[i].Description,
+			Sequence:          uploads[i].Sequence,
+			RecordedAt:        uploads[i].RecordedAt,
+			DurationSeconds:   uploads[i].DurationSeconds,
+			ThumbnailURL:      uploads[i].ThumbnailURL,
+			Topics:            uploads[i].Topics.Names(),
 			Related_Resources: uploads[i].Related_Resources,
 		}
-		err = c.vs.Create(&video)
+		occurrences[i] = uploads[i].Topics.Occurrences()
+		segments[i] = make([]models.TranscriptSegment, len(uploads[i].Transcript))
+		for j, seg := range uploads[i].Transcript {
+			segments[i][j] = models.TranscriptSegment{
+				StartMS:    seg.StartMS,
+				EndMS:      seg.EndMS,
+				Text:       seg.Text,
+				Confidence: seg.Confidence,
+			}
+		}
+
+		err := c.vs.Check(&videos[i])
+		if err == nil {
+			err = c.tos.Check(occurrences[i])
+		}
+		if err == nil {
+			err = c.ts.Check(segments[i])
+		}
 		if err != nil {
+			if pErr, ok := err.(PublicError); ok {
+				http.Error(w, fmt.Sprintf("Video %d: %s", i+1, pErr.Public()), http.StatusNotAcceptable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for i := range videos {
+		if err := c.vs.Create(&videos[i]); err != nil {
 			log.Println("Create", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if len(occurrences[i]) > 0 {
+			if err := c.tos.ReplaceForVideo(videos[i].ID, occurrences[i]); err != nil {
+				log.Println("Topics", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if len(segments[i]) > 0 {
+			if err := c.ts.ReplaceForVideo(videos[i].ID, segments[i]); err != nil {
+				log.Println("Transcript", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 	}
 
 	if err := json.NewEncoder(w).Encode(&uploads); err != nil {
@@ -133,15 +242,100 @@ func (c *Classes) Upload(w http.ResponseWriter, r *http.Request) {
 
 type UploadForm struct {
 	ClassName string            `json:"ClassName,omitempty"`
-	Videos    []UploadAudioForm `json:Videos,omitempty"`
+	Videos    []UploadAudioForm `json:"Videos,omitempty"`
 }
 
 type UploadAudioForm struct {
-	Audio_URL         string   `json:"Audio_URL,omitempty"`
-	Topics            []string `json:"Topics,omitempty"`
-	Related_Resources []string `json:"Related_Resources,omitempty"`
+	Audio_URL         string     `json:"Audio_URL,omitempty"`
+	Title             string     `json:"Title,omitempty"`
+	Description       string     `json:"Description,omitempty"`
+	Sequence          int        `json:"Sequence,omitempty"`
+	RecordedAt        *time.Time `json:"RecordedAt,omitempty"`
+	DurationSeconds   int        `json:"DurationSeconds,omitempty"`
+	ThumbnailURL      string     `json:"ThumbnailURL,omitempty"`
+	Topics            TopicsForm `json:"Topics,omitempty"`
+	Related_Resources []string   `json:"Related_Resources,omitempty"`
+	// Transcript is the speech-to-text output for the recording
+	Transcript []TranscriptSegmentForm `json:"Transcript,omitempty"`
+}
+
+// TopicsForm is a list of topics.  Each entry is either a plain string, the
+// original upload format, or an object that also says when the topic comes
+// up:
+//
+//	["graphs", {"Topic": "BFS", "Occurrences": [{"StartMS": 61000, "EndMS": 95000}]}]
+type TopicsForm []TopicForm
+
+type TopicForm struct {
+	Topic       string
+	Occurrences []OccurrenceForm `json:",omitempty"`
+}
+
+type OccurrenceForm struct {
+	StartMS int64
+	EndMS   int64
+}
+
+func (tf *TopicForm) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*tf = TopicForm{Topic: name}
+		return nil
+	}
+	type topicForm TopicForm
+	var form topicForm
+	if err := json.Unmarshal(data, &form); err != nil {
+		return err
+	}
+	*tf = TopicForm(form)
+	return nil
+}
+
+// MarshalJSON writes topics without timestamps as plain strings, so clients
+// that sent strings get strings back.
+func (tf TopicForm) MarshalJSON() ([]byte, error) {
+	if len(tf.Occurrences) == 0 {
+		return json.Marshal(tf.Topic)
+	}
+	type topicForm TopicForm
+	return json.Marshal(topicForm(tf))
+}
+
+// Names returns the topic names in the order given.
+func (tfs TopicsForm) Names() []string {
+	names := make([]string, len(tfs))
+	for i, tf := range tfs {
+		names[i] = tf.Topic
+	}
+	return names
+}
+
+// Occurrences flattens every timestamp in the form.
+func (tfs TopicsForm) Occurrences() []models.TopicOccurrence {
+	occurrences := []models.TopicOccurrence{}
+	for _, tf := range tfs {
+		for _, o := range tf.Occurrences {
+			occurrences = append(occurrences, models.TopicOccurrence{
+				Topic:   tf.Topic,
+				StartMS: o.StartMS,
+				EndMS:   o.EndMS,
+			})
+		}
+	}
+	return occurrences
+}
+
+type TranscriptSegmentForm struct {
+	StartMS    int64   `json:"StartMS"`
+	EndMS      int64   `json:"EndMS"`
+	Text       string  `json:"Text"`
+	Confidence float64 `json:"Confidence"`
 }
 
+// Finds the lectures of a class tagged with the keywords.  Mode "any" (the
+// default) finds lectures with at least one keyword and "all" only those
+// with every keyword.  Keywords tolerate typos and partial words, and
+// lectures matching the most keywords come first.
 func (c *Classes) GetByKeyword(w http.ResponseWriter, r *http.Request) {
 	form := GetKeywordForm{}
 	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
@@ -149,35 +343,643 @@ func (c *Classes) GetByKeyword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	keywords := form.Keywords
-	// for i := 0; i < len(keywords); i++ {
-	videos, err := c.vs.GetByKeyword(form.ClassID, keywords)
+	if !c.authorizeView(w, r, form.ClassID) {
+		return
+	}
+
+	matches, err := c.vs.GetByKeywords(form.ClassID, form.Keywords, form.Mode)
 	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Remove duplicates
-	// unique_videos := []models.Video{}
-	// seen_videos := map[uint]bool{}
-	// for _, val := range all_videos {
-	// 	if _, ok := seen_videos[val.ID]; !ok {
-	// 		unique_videos = append(unique_videos, val)
-	// 		seen_videos[val.ID] = true
-	// 	}
-	// }
+	ids := make([]uint, len(matches))
+	topics := []string{}
+	for i := range matches {
+		ids[i] = matches[i].Video.ID
+		topics = append(topics, matches[i].MatchedTopics...)
+	}
+	occurrences, err := c.tos.ByVideosAndTopics(ids, topics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Only the timestamps of topics a video itself matched are kept
+	byVideo := map[uint][]models.TopicOccurrence{}
+	for _, o := range occurrences {
+		byVideo[o.VideoID] = append(byVideo[o.VideoID], o)
+	}
 
-	for i := 0; i < len(videos); i++ {
-		videos[i].URL = strings.Replace(videos[i].URL, "gs://", "https://storage.googleapis.com/", 1)
+	results := make([]KeywordResult, len(matches))
+	for i, match := range matches {
+		c.signVideo(&match.Video)
+		results[i] = KeywordResult{
+			Video:           match.Video,
+			MatchedKeywords: match.MatchedKeywords,
+			MatchedTopics:   match.MatchedTopics,
+			Timestamps:      []models.TopicOccurrence{},
+		}
+		matched := map[string]bool{}
+		for _, topic := range match.MatchedTopics {
+			matched[strings.ToLower(topic)] = true
+		}
+		for _, o := range byVideo[match.Video.ID] {
+			if matched[strings.ToLower(o.Topic)] {
+				results[i].Timestamps = append(results[i].Timestamps, o)
+			}
+		}
 	}
 
-	if err := json.NewEncoder(w).Encode(&videos); err != nil {
+	if err := json.NewEncoder(w).Encode(&results); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Suggests topics of a class close to q, for "did you mean" prompts when a
+// keyword search finds little.  limit caps how many come back.
+func (c *Classes) SimilarTopics(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeView(w, r, class.ID) {
+		return
+	}
+
+	q := r.URL.Query()
+	limit, err := parseIntParam(q.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	matches, err := c.vs.SimilarTopics(class.ID, q.Get("q"), limit)
+	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(&matches); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Sends back every topic a class covers, with how many lectures cover it and
+// its first and last lecture.  order is frequency (the default) or
+// chronology, the order the class first covers them in.
+func (c *Classes) TopicMap(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeView(w, r, class.ID) {
+		return
+	}
+
+	topics, err := c.cts.ByClass(class.ID, r.URL.Query().Get("order"))
+	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(&topics); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// Suggests topics of a class starting with prefix as the user types, the
+// topics covered by the most lectures first.  limit caps how many come back.
+func (c *Classes) SuggestTopics(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeView(w, r, class.ID) {
+		return
+	}
+
+	q := r.URL.Query()
+	limit, err := parseIntParam(q.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	topics, err := c.cts.Suggest(class.ID, q.Get("prefix"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(&topics); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// KeywordResult is a video matching a search, along with the keywords it
+// matched, the topics they matched and every moment in it where one of those
+// topics comes up.
+type KeywordResult struct {
+	models.Video
+	MatchedKeywords []string
+	MatchedTopics   []string
+	Timestamps      []models.TopicOccurrence
+}
+
+// GetKeywordForm takes Keywords as a list, or as a single string for clients
+// written before lists were accepted.
 type GetKeywordForm struct {
-	ClassID  uint   `json:"ClassID,omitempty"`
-	Keywords string `json:"Keywords,omitempty"`
+	ClassID  uint         `json:"ClassID,omitempty"`
+	Keywords KeywordsForm `json:"Keywords,omitempty"`
+	Mode     string       `json:"Mode,omitempty"`
+}
+
+type KeywordsForm []string
+
+func (kf *KeywordsForm) UnmarshalJSON(data []byte) error {
+	var keyword string
+	if err := json.Unmarshal(data, &keyword); err == nil {
+		*kf = KeywordsForm{keyword}
+		return nil
+	}
+	var keywords []string
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return err
+	}
+	*kf = KeywordsForm(keywords)
+	return nil
+}
+
+// Enrolls the current user in a class as a student.  The user needs the
+// class's enrollment code from an instructor; TAs and co-instructors are
+// added by the instructors instead.
+func (c *Classes) Enroll(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	form := EnrollForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	code := strings.TrimSpace(form.Code)
+	if class.EnrollCode == "" || subtle.ConstantTimeCompare([]byte(code), []byte(class.EnrollCode)) != 1 {
+		http.Error(w, models.ErrEnrollCodeInvalid.Public(), http.StatusForbidden)
+		return
+	}
+
+	claims, _ := ClaimsFromContext(r.Context())
+	enrollment := models.Enrollment{
+		UserID:  claims.UserID,
+		ClassID: class.ID,
+		Role:    models.EnrollmentStudent,
+	}
+	if err := c.es.Create(&enrollment); err != nil {
+		if err == models.ErrAlreadyEnrolled {
+			http.Error(w, models.ErrAlreadyEnrolled.Public(), http.StatusConflict)
+			return
+		}
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(&enrollment); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type EnrollForm struct {
+	Code string `json:"Code,omitempty"`
+}
+
+// Sends back the code students enroll in a class with.  Classes made before
+// codes existed get one the first time it is asked for.  Instructors of the
+// class and admins can do this.
+func (c *Classes) EnrollCode(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeEdit(w, r, class) {
+		return
+	}
+
+	code := class.EnrollCode
+	if code == "" {
+		var err error
+		if code, err = c.cs.ResetEnrollCode(class.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := json.NewEncoder(w).Encode(EnrollForm{code}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Replaces the enrollment code of a class, so a code that leaked stops
+// working.  Students already enrolled stay enrolled.  Instructors of the
+// class and admins can do this.
+func (c *Classes) ResetEnrollCode(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeEdit(w, r, class) {
+		return
+	}
+
+	code, err := c.cs.ResetEnrollCode(class.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(EnrollForm{code}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Removes the current user from a class.  The professor of a class cannot
+// drop it.
+func (c *Classes) Drop(w http.ResponseWriter, r *http.Request) {
+	id, err := classIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := ClaimsFromContext(r.Context())
+	enrollment, err := c.es.ByUserAndClass(claims.UserID, id)
+	if err != nil {
+		if err == models.ErrNotEnrolled {
+			http.Error(w, models.ErrNotEnrolled.Public(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if enrollment.Role == models.EnrollmentProfessor {
+		http.Error(w, "The professor of a class cannot drop it", http.StatusForbidden)
+		return
+	}
+	if err := c.es.Delete(claims.UserID, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Lists every class the current user is enrolled in along with their role in
+// it.
+func (c *Classes) MyClasses(w http.ResponseWriter, r *http.Request) {
+	claims, _ := ClaimsFromContext(r.Context())
+	enrollments, err := c.es.ByUser(claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	classes, err := c.es.ClassesByUser(claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	byClass := map[uint]models.Enrollment{}
+	for _, e := range enrollments {
+		byClass[e.ClassID] = e
+	}
+	myClasses := make([]MyClass, 0, len(classes))
+	for _, class := range classes {
+		e := byClass[class.ID]
+		myClasses = append(myClasses, MyClass{
+			Class:      class,
+			Role:       e.Role,
+			EnrolledAt: e.EnrolledAt,
+		})
+	}
+
+	if err := json.NewEncoder(w).Encode(&myClasses); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type MyClass struct {
+	models.Class
+	Role       string
+	EnrolledAt time.Time
+}
+
+// Updates the name and description of a class.  The owner, co-instructors
+// and admins can do this.
+func (c *Classes) Update(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeEdit(w, r, class) {
+		return
+	}
+
+	form := ClassesCreateForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	class.Name = form.Name
+	class.Code = form.Code
+	class.Description = form.Description
+
+	if err := c.cs.Update(class); err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(class); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Soft deletes a class.  Only the owner and admins can do this.
+func (c *Classes) Delete(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeManage(w, r, class) {
+		return
+	}
+
+	if err := c.cs.Delete(class.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Brings back a deleted class.  Only the owner and admins can do this.
+func (c *Classes) Restore(w http.ResponseWriter, r *http.Request) {
+	id, err := classIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	class, err := c.cs.GetDeletedClassByID(id)
+	if err != nil {
+		if err == models.ErrClassNotFound {
+			http.Error(w, models.ErrClassNotFound.Public(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !c.authorizeManage(w, r, class) {
+		return
+	}
+
+	if err := c.cs.Restore(class.ID); err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	class.DeletedAt = nil
+
+	if err := json.NewEncoder(w).Encode(class); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Adds a co-instructor to a class by enrolling them with the professor role,
+// or promoting their existing enrollment.
+func (c *Classes) AddInstructor(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeManage(w, r, class) {
+		return
+	}
+	c.enrollAs(w, r, class, models.EnrollmentProfessor)
+}
+
+// Adds a TA to a class, or makes an enrolled student one.  Instructors of the
+// class and admins can do this.
+func (c *Classes) AddTA(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeEdit(w, r, class) {
+		return
+	}
+	c.enrollAs(w, r, class, models.EnrollmentTA)
+}
+
+// enrollAs enrolls the user in the request's InstructorForm in class with
+// role, or changes the role of the enrollment they already have.  Only those
+// who manage the class can take the professor role from a co-instructor.
+func (c *Classes) enrollAs(w http.ResponseWriter, r *http.Request, class *models.Class, role string) {
+	form := InstructorForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if form.UserID == class.OwnerID {
+		http.Error(w, "The owner of a class cannot be given another role in it", http.StatusForbidden)
+		return
+	}
+
+	enrollment, err := c.es.ByUserAndClass(form.UserID, class.ID)
+	switch err {
+	case nil:
+		claims, _ := ClaimsFromContext(r.Context())
+		if enrollment.Role == models.EnrollmentProfessor && role != models.EnrollmentProfessor && !c.canManage(claims, class) {
+			http.Error(w, "Only the owner of this class can change an instructor's role", http.StatusForbidden)
+			return
+		}
+		enrollment.Role = role
+		err = c.es.UpdateRole(enrollment)
+	case models.ErrNotEnrolled:
+		enrollment = &models.Enrollment{
+			UserID:  form.UserID,
+			ClassID: class.ID,
+			Role:    role,
+		}
+		err = c.es.Create(enrollment)
+		if err == nil {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}
+	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(enrollment); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type InstructorForm struct {
+	UserID uint `json:"UserID,omitempty"`
+}
+
+// Removes a co-instructor from a class.  The owner cannot be removed.
+func (c *Classes) RemoveInstructor(w http.ResponseWriter, r *http.Request) {
+	class, ok := c.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !c.authorizeManage(w, r, class) {
+		return
+	}
+
+	userID, err := strconv.ParseUint(mux.Vars(r)["userID"], 10, 32)
+	if err != nil {
+		http.Error(w, errInvalidID.Error(), http.StatusBadRequest)
+		return
+	}
+	if uint(userID) == class.OwnerID {
+		http.Error(w, "The owner of a class cannot be removed from it", http.StatusForbidden)
+		return
+	}
+	enrollment, err := c.es.ByUserAndClass(uint(userID), class.ID)
+	if err != nil || enrollment.Role != models.EnrollmentProfessor {
+		if err != nil && err != models.ErrNotEnrolled {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "User is not an instructor of this class", http.StatusNotFound)
+		return
+	}
+	if err := c.es.Delete(uint(userID), class.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// classFromVars loads the class named by the {id} path variable, writing an
+// error response and returning false if it cannot.
+func (c *Classes) classFromVars(w http.ResponseWriter, r *http.Request) (*models.Class, bool) {
+	id, err := classIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	class, err := c.cs.GetClassByID(id)
+	if err != nil {
+		if err == models.ErrClassNotFound {
+			http.Error(w, models.ErrClassNotFound.Public(), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return class, true
+}
+
+// videoListOptions reads how to filter and order a class's videos from the
+// query string:
+//
+//	order     sequence (default), recorded or created
+//	dir       asc (default) or desc
+//	from, to  recorded date range, as 2006-01-02 or RFC 3339; to is exclusive
+//	seq_from, seq_to  lecture number range, inclusive
+func videoListOptions(q url.Values) (models.VideoListOptions, error) {
+	opts := models.VideoListOptions{
+		OrderBy: q.Get("order"),
+	}
+	switch q.Get("dir") {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, errors.New("dir must be asc or desc")
+	}
+
+	var err error
+	if opts.RecordedFrom, err = parseDateParam(q.Get("from")); err != nil {
+		return opts, err
+	}
+	if opts.RecordedTo, err = parseDateParam(q.Get("to")); err != nil {
+		return opts, err
+	}
+	if opts.SequenceFrom, err = parseIntParam(q.Get("seq_from")); err != nil {
+		return opts, err
+	}
+	if opts.SequenceTo, err = parseIntParam(q.Get("seq_to")); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// parseDateParam accepts a plain date or a full RFC 3339 time.
+func parseDateParam(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a date like 2006-01-02", s)
+	}
+	return &t, nil
+}
+
+func parseIntParam(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a positive number", s)
+	}
+	return n, nil
+}
+
+// classIDFromVars reads the {id} path variable.
+func classIDFromVars(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		return 0, errInvalidID
+	}
+	return uint(id), nil
 }
@@ -0,0 +1,20 @@
+package controllers
+
+import "context"
+
+// contextKey is unexported so no other package can collide with the values
+// stored here.
+type contextKey string
+
+const claimsKey contextKey = "user_claims"
+
+// WithClaims returns a copy of ctx carrying the JWT claims of the current user.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext returns the claims stored by WithClaims, if any.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok && claims != nil
+}
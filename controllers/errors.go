@@ -1,5 +1,9 @@
 package controllers
 
+import "errors"
+
+var errInvalidID = errors.New("ID in URL must be a positive number")
+
 type PublicError interface {
 	error
 	Public() string
@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/models"
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
+	"github.com/gorilla/mux"
+)
+
+// media turns the recordings of videos, and anything else kept in the store,
+// into signed links that stop working after ttl.  It is embedded in every
+// controller that sends them back, and must only be used once the user is
+// known to be allowed to see the class.  Only objects the class owns, those
+// under its storage.ClassPrefix in keyPrefix, are ever signed; links to the
+// rest of the store are given as plain, unsigned ones if the store is
+// public, and left as they were saved if not.
+type media struct {
+	store     storage.BlobStore
+	ttl       time.Duration
+	keyPrefix string
+}
+
+// PlaybackLink is a link to a recording and, when it is signed, when it
+// stops working.
+type PlaybackLink struct {
+	URL       string
+	ExpiresAt *time.Time `json:",omitempty"`
+}
+
+// playbackLink is where the app should play a video from.  Recordings its
+// class owns in the store get a signed link; the rest get a plain one, or
+// keep the URL they were saved with, and never expire.
+func (m *media) playbackLink(video *models.Video) PlaybackLink {
+	key := video.ObjectKey
+	if key == "" {
+		var ok bool
+		if key, ok = m.store.Key(video.URL); !ok {
+			return PlaybackLink{URL: video.URL}
+		}
+	}
+	expires := time.Now().Add(m.ttl).UTC()
+	u, signed, err := m.link(video.ClassID, key, expires)
+	if err == storage.ErrNotPublic {
+		return PlaybackLink{URL: video.URL}
+	}
+	if err != nil {
+		log.Println("Could not sign link to video", video.ID, "in storage:", err)
+		return PlaybackLink{URL: video.URL}
+	}
+	if !signed {
+		return PlaybackLink{URL: u}
+	}
+	return PlaybackLink{URL: u, ExpiresAt: &expires}
+}
+
+// signVideo replaces the recording and thumbnail links of a video about to
+// be sent back with signed ones.
+func (m *media) signVideo(video *models.Video) {
+	video.URL = m.playbackLink(video).URL
+	video.ThumbnailURL = m.signLink(video.ClassID, video.ThumbnailURL)
+}
+
+// signLink signs ref if it points at an object classID owns in the store.
+// Other links into the store are made plain and the rest returned
+// untouched, so links users typed in cannot reach another class's objects.
+func (m *media) signLink(classID uint, ref string) string {
+	key, ok := m.store.Key(ref)
+	if !ok {
+		return ref
+	}
+	u, _, err := m.link(classID, key, time.Now().Add(m.ttl))
+	if err == storage.ErrNotPublic {
+		return ref
+	}
+	if err != nil {
+		log.Println("Could not sign link to", key, "in storage:", err)
+		return ref
+	}
+	return u
+}
+
+// link signs a link to key that stops working at expires, if classID owns
+// it.  Other keys, and every key of a store with no credentials to sign
+// with, get the plain link instead, and signed is false; a private store
+// has none and gives storage.ErrNotPublic.
+func (m *media) link(classID uint, key string, expires time.Time) (u string, signed bool, err error) {
+	if !m.owns(classID, key) {
+		u, err = m.store.URL(key)
+		return u, false, err
+	}
+	u, err = m.store.SignedURL(key, expires)
+	if err == storage.ErrNoCredentials {
+		u, err = m.store.URL(key)
+		return u, false, err
+	}
+	return u, err == nil, err
+}
+
+// owns reports whether key is one of classID's objects.
+func (m *media) owns(classID uint, key string) bool {
+	key, err := storage.CleanKey(key)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(key, storage.ClassPrefix(m.keyPrefix, classID))
+}
+
+func NewMedia(store *storage.Local) *Media {
+	return &Media{
+		store: store,
+	}
+}
+
+// Media serves the files of local storage to whoever holds a signed link to
+// them, so it sits outside the JWT protected API.
+type Media struct {
+	store *storage.Local
+}
+
+// Sends back the file named by the {key} path variable if the link's
+// signature checks out and has not expired.
+func (m *Media) Serve(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	switch err := m.store.Verify(key, r.URL.Query(), time.Now()); err {
+	case nil:
+	case storage.ErrURLExpired:
+		http.Error(w, "Link has expired", http.StatusForbidden)
+		return
+	default:
+		http.Error(w, "Link is invalid", http.StatusForbidden)
+		return
+	}
+
+	serveFile(w, r, m.store, key)
+}
+
+// mediaTypes are the content types of the recordings kept in the store,
+// which the system's MIME table may not know.
+var mediaTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".wav":  "audio/wav",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+}
+
+// serveFile sends back the object at key in local storage.  Range requests
+// get 206 Partial Content so players can seek, and the ETag and
+// Last-Modified headers let clients revalidate with conditional requests.
+func serveFile(w http.ResponseWriter, r *http.Request, store *storage.Local, key string) {
+	f, info, err := store.Open(key)
+	if err != nil {
+		if err == storage.ErrNotFound || err == storage.ErrKeyInvalid {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if t, ok := mediaTypes[strings.ToLower(path.Ext(key))]; ok {
+		w.Header().Set("Content-Type", t)
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	w.Header().Set("Cache-Control", "private")
+	http.ServeContent(w, r, path.Base(key), info.ModTime(), f)
+}
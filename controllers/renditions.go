@@ -0,0 +1,257 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/hls"
+	"github.com/TerrenceHo/CalHacks4-Backend/models"
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
+	"github.com/gorilla/mux"
+)
+
+func NewRenditions(renditions models.RenditionService, videos models.VideoService, classes models.ClassService, enrollments models.EnrollmentService, store storage.BlobStore, ttl time.Duration, keyPrefix string) *Renditions {
+	return &Renditions{
+		classAccess: classAccess{
+			cs: classes,
+			es: enrollments,
+		},
+		media: media{store, ttl, keyPrefix},
+		vs:    videos,
+		rs:    renditions,
+	}
+}
+
+// Renditions serves the HLS playlists of videos the pipeline has encoded at
+// several bitrates, so players can switch quality as the network allows.
+type Renditions struct {
+	classAccess
+	media
+	vs models.VideoService
+	rs models.RenditionService
+}
+
+// RenditionForm registers a rendition of a video.  Each segment's Key is
+// its object key, or a link into the store.
+type RenditionForm struct {
+	Name             string        `json:"Name,omitempty"`
+	Bandwidth        int           `json:"Bandwidth,omitempty"`
+	AverageBandwidth int           `json:"AverageBandwidth,omitempty"`
+	Width            int           `json:"Width,omitempty"`
+	Height           int           `json:"Height,omitempty"`
+	Codecs           string        `json:"Codecs,omitempty"`
+	FrameRate        float64       `json:"FrameRate,omitempty"`
+	Segments         []SegmentForm `json:"Segments,omitempty"`
+}
+
+type SegmentForm struct {
+	DurationMS int64  `json:"DurationMS,omitempty"`
+	Key        string `json:"Key,omitempty"`
+}
+
+// Sends back the master playlist of a video, listing every rendition.  The
+// rendition playlists are linked relative to it, so they are fetched with
+// the same credentials.
+func (rc *Renditions) Master(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := rc.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !rc.authorizeView(w, r, video.ClassID) {
+		return
+	}
+
+	renditions, err := rc.rs.ByVideo(video.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(renditions) == 0 {
+		http.Error(w, models.ErrRenditionNotFound.Public(), http.StatusNotFound)
+		return
+	}
+	variants := make([]hls.Variant, len(renditions))
+	for i, rendition := range renditions {
+		variants[i] = hls.Variant{
+			URI:              fmt.Sprintf("%d.m3u8", rendition.ID),
+			Bandwidth:        rendition.Bandwidth,
+			AverageBandwidth: rendition.AverageBandwidth,
+			Width:            rendition.Width,
+			Height:           rendition.Height,
+			Codecs:           rendition.Codecs,
+			FrameRate:        rendition.FrameRate,
+		}
+	}
+	writePlaylist(w, func(buf *bytes.Buffer) error {
+		return hls.WriteMaster(buf, variants)
+	})
+}
+
+// Sends back the media playlist of one rendition with a signed link to each
+// segment.  The links last the configured TTL beyond the length of the
+// lecture, so watching it straight through never meets an expired one.
+func (rc *Renditions) Media(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := rc.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !rc.authorizeView(w, r, video.ClassID) {
+		return
+	}
+	rendition, ok := rc.renditionFromVars(w, r, video)
+	if !ok {
+		return
+	}
+
+	segments, err := rc.rs.Segments(rendition.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var length time.Duration
+	for _, s := range segments {
+		length += time.Duration(s.DurationMS) * time.Millisecond
+	}
+	ttl := rc.ttl + length
+	if ttl > storage.MaxSignedURLTTL {
+		ttl = storage.MaxSignedURLTTL
+	}
+	expires := time.Now().Add(ttl)
+
+	entries := make([]hls.Segment, len(segments))
+	for i, s := range segments {
+		u, _, err := rc.link(video.ClassID, s.ObjectKey, expires)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries[i] = hls.Segment{
+			URI:      u,
+			Duration: time.Duration(s.DurationMS) * time.Millisecond,
+		}
+	}
+	writePlaylist(w, func(buf *bytes.Buffer) error {
+		return hls.WriteMedia(buf, entries)
+	})
+}
+
+// Registers a rendition of a video and its segments, replacing any of the
+// same name.  Instructors of its class and admins can do this.
+func (rc *Renditions) Create(w http.ResponseWriter, r *http.Request) {
+	video, class, ok := rc.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !rc.authorizeEdit(w, r, class) {
+		return
+	}
+
+	form := RenditionForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rendition := models.Rendition{
+		VideoID:          video.ID,
+		Name:             form.Name,
+		Bandwidth:        form.Bandwidth,
+		AverageBandwidth: form.AverageBandwidth,
+		Width:            form.Width,
+		Height:           form.Height,
+		Codecs:           form.Codecs,
+		FrameRate:        form.FrameRate,
+	}
+	segments := make([]models.RenditionSegment, len(form.Segments))
+	for i, s := range form.Segments {
+		key := s.Key
+		if k, ok := rc.store.Key(s.Key); ok {
+			key = k
+		}
+		segments[i] = models.RenditionSegment{
+			DurationMS: s.DurationMS,
+			ObjectKey:  key,
+		}
+	}
+	if err := rc.rs.Save(&rendition, segments); err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(&rendition); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Removes a rendition from a video's playlists.  Instructors of its class
+// and admins can do this.
+func (rc *Renditions) Delete(w http.ResponseWriter, r *http.Request) {
+	video, class, ok := rc.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !rc.authorizeEdit(w, r, class) {
+		return
+	}
+	rendition, ok := rc.renditionFromVars(w, r, video)
+	if !ok {
+		return
+	}
+	if err := rc.rs.Delete(rendition.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rc *Renditions) videoFromVars(w http.ResponseWriter, r *http.Request) (*models.Video, *models.Class, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, errInvalidID.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return loadVideo(w, rc.vs, rc.cs, uint(id))
+}
+
+// renditionFromVars loads the rendition named by the {rendition} path
+// variable, writing an error response and returning false unless it is one
+// of video's.
+func (rc *Renditions) renditionFromVars(w http.ResponseWriter, r *http.Request, video *models.Video) (*models.Rendition, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["rendition"], 10, 32)
+	if err != nil {
+		http.Error(w, errInvalidID.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	rendition, err := rc.rs.ByID(uint(id))
+	if err == models.ErrRenditionNotFound || err == nil && rendition.VideoID != video.ID {
+		http.Error(w, models.ErrRenditionNotFound.Public(), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return rendition, true
+}
+
+// writePlaylist sends back the playlist written by write.  Playlists hold
+// signed links, so they are never cached.
+func writePlaylist(w http.ResponseWriter, write func(*bytes.Buffer) error) {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", hls.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
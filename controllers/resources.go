@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/models"
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
+	"github.com/gorilla/mux"
+)
+
+func NewResources(resources models.ResourceService, videos models.VideoService, classes models.ClassService, enrollments models.EnrollmentService, store storage.BlobStore, ttl time.Duration, keyPrefix string) *Resources {
+	return &Resources{
+		classAccess: classAccess{
+			cs: classes,
+			es: enrollments,
+		},
+		vs:    videos,
+		rs:    resources,
+		media: media{store, ttl, keyPrefix},
+	}
+}
+
+type Resources struct {
+	classAccess
+	media
+	vs models.VideoService
+	rs models.ResourceService
+}
+
+// ResourceForm is what a user sends to add or change a related resource.
+// Kind is guessed from the URL when left out.
+type ResourceForm struct {
+	URL         string `json:"URL,omitempty"`
+	Title       string `json:"Title,omitempty"`
+	Kind        string `json:"Kind,omitempty"`
+	TimestampMS *int64 `json:"TimestampMS,omitempty"`
+}
+
+// Lists the related resources of a video.  Attachments kept in the store
+// come back with signed links.
+func (rc *Resources) ByVideo(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := rc.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !rc.authorizeView(w, r, video.ClassID) {
+		return
+	}
+
+	resources, err := rc.rs.ByVideo(video.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range resources {
+		resources[i].URL = rc.signLink(video.ClassID, resources[i].URL)
+	}
+	if err := json.NewEncoder(w).Encode(&resources); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Adds a related resource to a video.  Anyone enrolled in the class can;
+// resources added by its instructors are marked as from the professor, the
+// rest as from students.
+func (rc *Resources) Create(w http.ResponseWriter, r *http.Request) {
+	video, class, ok := rc.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !rc.authorizeView(w, r, video.ClassID) {
+		return
+	}
+	claims, _ := ClaimsFromContext(r.Context())
+	canEdit, err := rc.canEdit(claims, class)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	form := ResourceForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resource := models.Resource{
+		VideoID:     video.ID,
+		URL:         form.URL,
+		Title:       form.Title,
+		Kind:        form.Kind,
+		TimestampMS: form.TimestampMS,
+		Origin:      models.ResourceOriginStudent,
+		CreatedByID: claims.UserID,
+	}
+	if canEdit {
+		resource.Origin = models.ResourceOriginProfessor
+	}
+	if err := rc.rs.Create(&resource); err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(&resource); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Changes a related resource.  Its author and the instructors of its class
+// can do this.
+func (rc *Resources) Update(w http.ResponseWriter, r *http.Request) {
+	resource, ok := rc.resourceFromVars(w, r)
+	if !ok {
+		return
+	}
+
+	form := ResourceForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resource.URL = form.URL
+	resource.Title = form.Title
+	resource.Kind = form.Kind
+	resource.TimestampMS = form.TimestampMS
+
+	if err := rc.rs.Update(resource); err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(resource); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Deletes a related resource.  Its author and the instructors of its class
+// can do this.
+func (rc *Resources) Delete(w http.ResponseWriter, r *http.Request) {
+	resource, ok := rc.resourceFromVars(w, r)
+	if !ok {
+		return
+	}
+	if err := rc.rs.Delete(resource.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rc *Resources) videoFromVars(w http.ResponseWriter, r *http.Request) (*models.Video, *models.Class, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, errInvalidID.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return loadVideo(w, rc.vs, rc.cs, uint(id))
+}
+
+// resourceFromVars loads the resource named by the {id} path variable and
+// checks the current user may change it, writing an error response and
+// returning false if not.
+func (rc *Resources) resourceFromVars(w http.ResponseWriter, r *http.Request) (*models.Resource, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, errInvalidID.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	resource, err := rc.rs.ByID(uint(id))
+	if err != nil {
+		if err == models.ErrRelatedResourceNotFound {
+			http.Error(w, models.ErrRelatedResourceNotFound.Public(), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	_, class, ok := loadVideo(w, rc.vs, rc.cs, resource.VideoID)
+	if !ok {
+		return nil, false
+	}
+
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	if resource.CreatedByID != 0 && resource.CreatedByID == claims.UserID {
+		return resource, true
+	}
+	if !rc.authorizeEdit(w, r, class) {
+		return nil, false
+	}
+	return resource, true
+}
@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/models"
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
+)
+
+func NewSearch(search models.SearchService, classes models.ClassService, enrollments models.EnrollmentService, store storage.BlobStore, ttl time.Duration, keyPrefix string) *Search {
+	return &Search{
+		classAccess: classAccess{
+			cs: classes,
+			es: enrollments,
+		},
+		ss:    search,
+		media: media{store, ttl, keyPrefix},
+	}
+}
+
+type Search struct {
+	classAccess
+	media
+	ss models.SearchService
+}
+
+// SearchPage is one page of search results, grouped by class.  Classes are
+// ordered by their best result.  Total counts every matching video, not
+// just the ones on this page.
+type SearchPage struct {
+	Query   string
+	Total   int
+	Offset  int
+	Classes []ClassResults
+}
+
+// ClassResults are the results on a page that belong to one class.
+type ClassResults struct {
+	Class   models.Class
+	Results []models.SearchResult
+}
+
+// Searches the titles, topics, descriptions, resources and transcripts of
+// lectures.  q takes web search syntax: words must all appear, "or" between
+// words means either, "quoted words" must appear together and -word leaves
+// out lectures with that word.
+//
+// Every class the user is enrolled in is searched, or every class for admins.
+// class_id, given once or more or as a comma separated list, narrows the
+// search to those classes.  from and to narrow it to lectures recorded in a
+// date range, and offset and limit page through the results.
+func (s *Search) Search(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	opts := models.SearchOptions{}
+	var err error
+	if opts.RecordedFrom, err = parseDateParam(q.Get("from")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.RecordedTo, err = parseDateParam(q.Get("to")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Offset, err = parseIntParam(q.Get("offset")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Limit, err = parseIntParam(q.Get("limit")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	classes, err := s.viewableClasses(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	byID := map[uint]models.Class{}
+	for _, class := range classes {
+		byID[class.ID] = class
+	}
+
+	wanted, err := classIDsParam(q["class_id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(wanted) > 0 {
+		for _, id := range wanted {
+			if _, ok := byID[id]; !ok {
+				s.refuseClass(w, id)
+				return
+			}
+		}
+		opts.ClassIDs = wanted
+	} else {
+		for _, class := range classes {
+			opts.ClassIDs = append(opts.ClassIDs, class.ID)
+		}
+	}
+
+	page := SearchPage{
+		Query:   q.Get("q"),
+		Offset:  opts.Offset,
+		Classes: []ClassResults{},
+	}
+	if len(opts.ClassIDs) == 0 {
+		// Not enrolled in anything, so there is nothing to search
+		if err := json.NewEncoder(w).Encode(&page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	results, total, err := s.ss.Search(q.Get("q"), opts)
+	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Total = total
+
+	// Results come best first, so the first result seen for a class is its
+	// best and classes end up in order of their best result
+	group := map[uint]int{}
+	for _, result := range results {
+		s.signVideo(&result.Video)
+		i, ok := group[result.Video.ClassID]
+		if !ok {
+			i = len(page.Classes)
+			group[result.Video.ClassID] = i
+			page.Classes = append(page.Classes, ClassResults{
+				Class: byID[result.Video.ClassID],
+			})
+		}
+		page.Classes[i].Results = append(page.Classes[i].Results, result)
+	}
+
+	if err := json.NewEncoder(w).Encode(&page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// refuseClass explains why a class the user asked to search cannot be: it
+// does not exist or they are not enrolled in it.
+func (s *Search) refuseClass(w http.ResponseWriter, id uint) {
+	_, err := s.cs.GetClassByID(id)
+	switch err {
+	case nil:
+		http.Error(w, "You must be enrolled in this class", http.StatusForbidden)
+	case models.ErrClassNotFound:
+		http.Error(w, models.ErrClassNotFound.Public(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// classIDsParam reads class IDs given as repeated parameters, comma separated
+// lists or both.
+func classIDsParam(values []string) ([]uint, error) {
+	ids := []uint{}
+	seen := map[uint]bool{}
+	for _, value := range values {
+		for _, s := range strings.Split(value, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			id, err := strconv.ParseUint(s, 10, 32)
+			if err != nil || id == 0 {
+				return nil, errInvalidID
+			}
+			if !seen[uint(id)] {
+				seen[uint(id)] = true
+				ids = append(ids, uint(id))
+			}
+		}
+	}
+	return ids, nil
+}
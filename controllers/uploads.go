@@ -0,0 +1,618 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/models"
+	"github.com/TerrenceHo/CalHacks4-Backend/rand"
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxFormFieldBytes is the most read of any field of a multipart upload
+	// other than the file.
+	maxFormFieldBytes = 1 << 10
+	// multipartOverhead allows for the boundaries and headers of a multipart
+	// upload on top of its file.
+	multipartOverhead = 1 << 20
+)
+
+func NewUploads(uploads models.UploadService, videos models.VideoService, classes models.ClassService, enrollments models.EnrollmentService, store storage.BlobStore, dir, keyPrefix string) *Uploads {
+	return &Uploads{
+		classAccess: classAccess{
+			cs: classes,
+			es: enrollments,
+		},
+		us:        uploads,
+		vs:        videos,
+		store:     store,
+		dir:       dir,
+		keyPrefix: keyPrefix,
+		busy:      map[uint]bool{},
+	}
+}
+
+// Uploads takes recordings straight from instructors, either whole in one
+// multipart request or in chunks that can be resumed after a dropped
+// connection.  Files are gathered in dir, checked against their checksum and
+// type, then sent to the store under keyPrefix and given a pending video.
+// busy holds the uploads a request is working on, so two never write to the
+// same part file at once.
+type Uploads struct {
+	classAccess
+	us        models.UploadService
+	vs        models.VideoService
+	store     storage.BlobStore
+	dir       string
+	keyPrefix string
+
+	mu   sync.Mutex
+	busy map[uint]bool
+}
+
+// ResumableUploadForm starts a resumable upload.  SHA256 is the hex digest
+// of the whole file, checked once every byte has arrived.
+type ResumableUploadForm struct {
+	Filename    string `json:"Filename,omitempty"`
+	Title       string `json:"Title,omitempty"`
+	ContentType string `json:"ContentType,omitempty"`
+	Size        int64  `json:"Size,omitempty"`
+	SHA256      string `json:"SHA256,omitempty"`
+}
+
+// Takes a whole recording as the "file" field of a multipart form, with its
+// hex SHA-256 digest in the "sha256" field and an optional "title".  The
+// new pending video is sent back.  Instructors of the class and admins can
+// do this.
+func (u *Uploads) Direct(w http.ResponseWriter, r *http.Request) {
+	class, ok := u.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !u.authorizeEdit(w, r, class) {
+		return
+	}
+	claims, _ := ClaimsFromContext(r.Context())
+
+	r.Body = http.MaxBytesReader(w, r.Body, u.us.MaxSize()+multipartOverhead)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload := models.Upload{
+		ClassID: class.ID,
+		UserID:  claims.UserID,
+	}
+	var f *os.File
+	var sum hash.Hash
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readError(w, err)
+			return
+		}
+		switch part.FormName() {
+		case "file":
+			if f != nil {
+				http.Error(w, "Only one file can be uploaded at a time", http.StatusBadRequest)
+				return
+			}
+			f, err = ioutil.TempFile(u.dir, "direct-")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			upload.Filename = part.FileName()
+			upload.ContentType = part.Header.Get("Content-Type")
+			sum = sha256.New()
+			dst := &fileWriter{f: f}
+			upload.Size, err = io.Copy(io.MultiWriter(dst, sum), part)
+			if dst.err != nil {
+				http.Error(w, dst.err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err != nil {
+				readError(w, err)
+				return
+			}
+		case "sha256":
+			upload.SHA256 = formValue(part)
+		case "title":
+			upload.Title = formValue(part)
+		}
+	}
+	if f == nil {
+		http.Error(w, "A file is required", http.StatusBadRequest)
+		return
+	}
+	upload.Offset = upload.Size
+	if err := u.us.Check(&upload); err != nil {
+		uploadError(w, err)
+		return
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != upload.SHA256 {
+		uploadError(w, models.ErrUploadChecksumMismatch)
+		return
+	}
+
+	video, err := u.finish(&upload, f)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(video); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Starts a resumable upload to a class.  Its link is sent back in the
+// Location header; the file is then sent there in chunks with Append.
+// Instructors of the class and admins can do this.
+func (u *Uploads) Create(w http.ResponseWriter, r *http.Request) {
+	class, ok := u.classFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !u.authorizeEdit(w, r, class) {
+		return
+	}
+	claims, _ := ClaimsFromContext(r.Context())
+
+	form := ResumableUploadForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload := models.Upload{
+		ClassID:     class.ID,
+		UserID:      claims.UserID,
+		Filename:    form.Filename,
+		Title:       form.Title,
+		ContentType: form.ContentType,
+		Size:        form.Size,
+		SHA256:      form.SHA256,
+	}
+	if err := u.us.Create(&upload); err != nil {
+		uploadError(w, err)
+		return
+	}
+	f, err := os.Create(u.partPath(&upload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/uploads/%d", upload.ID))
+	setUploadHeaders(w, &upload)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(&upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Sends back how much of an upload has arrived, in the Upload-Offset header
+// and the body, so an interrupted upload knows where to carry on from.
+func (u *Uploads) Status(w http.ResponseWriter, r *http.Request) {
+	upload, ok := u.uploadFromVars(w, r)
+	if !ok {
+		return
+	}
+	setUploadHeaders(w, upload)
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Adds the request body to an upload.  The Upload-Offset header must say
+// where the chunk starts, which must be where the upload has got to; if not
+// 409 Conflict is sent back along with the right offset.  The chunk that
+// completes the upload has the whole file checked and stored, and the new
+// pending video's ID set on the upload.  If storing fails, an empty chunk at
+// the end of the upload tries again.  A chunk sent while another is still
+// arriving gets 423 Locked.
+func (u *Uploads) Append(w http.ResponseWriter, r *http.Request) {
+	upload, ok := u.uploadFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !u.claim(upload.ID) {
+		setUploadHeaders(w, upload)
+		http.Error(w, models.ErrUploadBusy.Public(), http.StatusLocked)
+		return
+	}
+	defer u.release(upload.ID)
+	// A chunk may have finished between loading the upload and claiming it
+	upload, err := u.us.ByID(upload.ID)
+	if err != nil {
+		if err == models.ErrUploadNotFound {
+			http.Error(w, models.ErrUploadNotFound.Public(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset header is required", http.StatusBadRequest)
+		return
+	}
+	if upload.VideoID != 0 || offset != upload.Offset {
+		setUploadHeaders(w, upload)
+		http.Error(w, models.ErrUploadOffsetInvalid.Public(), http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(u.partPath(upload), os.O_RDWR, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	// Anything past the offset is left from a chunk that failed to save
+	if err := f.Truncate(upload.Offset); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, upload.Size-upload.Offset)
+	n, copyErr := io.Copy(f, body)
+	// Whatever arrived before a dropped connection is kept, so the client
+	// can carry on from there
+	upload.Offset += n
+	if err := u.us.Update(upload); err != nil {
+		uploadError(w, err)
+		return
+	}
+	setUploadHeaders(w, upload)
+	if copyErr != nil {
+		http.Error(w, copyErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if upload.Done() {
+		sum := sha256.New()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := io.Copy(sum, f); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hex.EncodeToString(sum.Sum(nil)) != upload.SHA256 {
+			// The file is wrong somewhere, so it has to be sent again
+			u.discard(upload)
+			uploadError(w, models.ErrUploadChecksumMismatch)
+			return
+		}
+		video, err := u.finish(upload, f)
+		if err == models.ErrUploadTypeInvalid {
+			u.discard(upload)
+		}
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		upload.VideoID = video.ID
+		if err := u.us.Update(upload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		os.Remove(f.Name())
+	}
+
+	if err := json.NewEncoder(w).Encode(upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Abandons an upload and throws away what has arrived of it.
+func (u *Uploads) Delete(w http.ResponseWriter, r *http.Request) {
+	upload, ok := u.uploadFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !u.claim(upload.ID) {
+		http.Error(w, models.ErrUploadBusy.Public(), http.StatusLocked)
+		return
+	}
+	defer u.release(upload.ID)
+	if err := u.discard(upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish checks the content of a complete upload really is the type it
+// claims to be, stores it and creates its pending video.
+func (u *Uploads) finish(upload *models.Upload, f *os.File) (*models.Video, error) {
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// Sniffing cannot tell every recording apart, so only a type it is sure
+	// of is held against the upload
+	sniffed := http.DetectContentType(head[:n])
+	if sniffed != "application/octet-stream" && !u.us.AllowsType(sniffed) {
+		return nil, models.ErrUploadTypeInvalid
+	}
+
+	token, err := rand.String(12)
+	if err != nil {
+		return nil, err
+	}
+	key := storage.ClassPrefix(u.keyPrefix, upload.ClassID) + token + "-" + keyFilename(upload.Filename)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := u.store.Put(key, f, upload.Size, upload.ContentType); err != nil {
+		return nil, err
+	}
+
+	title := upload.Title
+	if title == "" {
+		title = strings.TrimSuffix(upload.Filename, path.Ext(upload.Filename))
+	}
+	video := models.Video{
+		ClassID:   upload.ClassID,
+		ObjectKey: key,
+		Title:     title,
+		Status:    models.VideoStatusPending,
+	}
+	if err := u.vs.Create(&video); err != nil {
+		if dErr := u.store.Delete(key); dErr != nil {
+			log.Println("Could not remove upload", key, "from storage:", dErr)
+		}
+		return nil, err
+	}
+	return &video, nil
+}
+
+// keyFilename makes an uploaded file's name safe to use in an object key.
+// Anything but letters, digits, dots, dashes and underscores becomes a dash,
+// so "Lecture 1: Intro.mp4" is stored as "Lecture-1-Intro.mp4".
+func keyFilename(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range name {
+		if 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '.' || r == '_' || r == '-' {
+			b.WriteRune(r)
+			dash = r == '-'
+			continue
+		}
+		if !dash {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	clean := strings.Trim(b.String(), "-.")
+	if clean == "" {
+		return "upload"
+	}
+	return clean
+}
+
+func (u *Uploads) discard(upload *models.Upload) error {
+	if err := u.us.Delete(upload.ID); err != nil {
+		return err
+	}
+	err := os.Remove(u.partPath(upload))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Sweep throws away the uploads no chunk has reached since before, with
+// their part files.  Part files no upload owns any more, and files of
+// direct uploads as old, are left by crashes and removed as well.
+func (u *Uploads) Sweep(before time.Time) error {
+	uploads, err := u.us.Stale(before)
+	if err != nil {
+		return err
+	}
+	for i := range uploads {
+		// One still being written to is not abandoned
+		if !u.claim(uploads[i].ID) {
+			continue
+		}
+		err := u.discard(&uploads[i])
+		u.release(uploads[i].ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	files, err := ioutil.ReadDir(u.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || fi.ModTime().After(before) {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, ".part"):
+			// Kept for as long as its upload is
+			id, err := strconv.ParseUint(strings.TrimSuffix(name, ".part"), 10, 32)
+			if err == nil {
+				if _, err := u.us.ByID(uint(id)); err != models.ErrUploadNotFound {
+					continue
+				}
+			}
+		case strings.HasPrefix(name, "direct-"):
+		default:
+			continue
+		}
+		if err := os.Remove(filepath.Join(u.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim marks an upload as being worked on, returning false if another
+// request already is.  Every claim must be released.
+func (u *Uploads) claim(id uint) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy[id] {
+		return false
+	}
+	u.busy[id] = true
+	return true
+}
+
+func (u *Uploads) release(id uint) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.busy, id)
+}
+
+// partPath is the file the chunks of an upload are gathered in.
+func (u *Uploads) partPath(upload *models.Upload) string {
+	return filepath.Join(u.dir, fmt.Sprintf("%d.part", upload.ID))
+}
+
+func (u *Uploads) classFromVars(w http.ResponseWriter, r *http.Request) (*models.Class, bool) {
+	id, err := classIDFromVars(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	class, err := u.cs.GetClassByID(id)
+	if err != nil {
+		if err == models.ErrClassNotFound {
+			http.Error(w, models.ErrClassNotFound.Public(), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return class, true
+}
+
+// uploadFromVars loads the upload named by the {id} path variable, writing
+// an error response and returning false unless the current user started
+// it.  Admins can reach every upload.
+func (u *Uploads) uploadFromVars(w http.ResponseWriter, r *http.Request) (*models.Upload, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, errInvalidID.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	upload, err := u.us.ByID(uint(id))
+	if err != nil {
+		if err == models.ErrUploadNotFound {
+			http.Error(w, models.ErrUploadNotFound.Public(), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	if upload.UserID != claims.UserID && claims.UserType != models.RoleAdmin {
+		http.Error(w, models.ErrUploadNotFound.Public(), http.StatusNotFound)
+		return nil, false
+	}
+	return upload, true
+}
+
+func setUploadHeaders(w http.ResponseWriter, upload *models.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+}
+
+// uploadError picks the status for a failed upload.
+func uploadError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrUploadTooLarge:
+		http.Error(w, models.ErrUploadTooLarge.Public(), http.StatusRequestEntityTooLarge)
+	case models.ErrUploadTypeInvalid:
+		http.Error(w, models.ErrUploadTypeInvalid.Public(), http.StatusUnsupportedMediaType)
+	case models.ErrUploadChecksumMismatch:
+		http.Error(w, models.ErrUploadChecksumMismatch.Public(), http.StatusUnprocessableEntity)
+	default:
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// fileWriter keeps the error writing to f, so a failed disk can be told
+// apart from a failed request.
+type fileWriter struct {
+	f   *os.File
+	err error
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	n, err := fw.f.Write(p)
+	if err != nil && fw.err == nil {
+		fw.err = err
+	}
+	return n, err
+}
+
+// readError picks the status for a request body that could not be read:
+// 413 when it was cut off for being too large, otherwise 400.
+func readError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, models.ErrUploadTooLarge.Public(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func formValue(part *multipart.Part) string {
+	b, _ := ioutil.ReadAll(io.LimitReader(part, maxFormFieldBytes))
+	return strings.TrimSpace(string(b))
+}
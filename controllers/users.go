@@ -2,24 +2,42 @@ package controllers
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/TerrenceHo/CalHacks4-Backend/mail"
 	"github.com/TerrenceHo/CalHacks4-Backend/models"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 )
 
-func NewUsers(users models.UserService, signKey []byte) *Users {
+// AccessTokenDuration is how long a JWT is accepted before the app has to
+// trade its refresh token for a new one.
+const AccessTokenDuration = 15 * time.Minute
+
+func NewUsers(users models.UserService, refreshTokens models.RefreshTokenService, mailer mail.Sender, signKey []byte, resetURL string) *Users {
 	return &Users{
-		us:      users,
-		signKey: signKey,
+		us:       users,
+		rts:      refreshTokens,
+		mailer:   mailer,
+		signKey:  signKey,
+		resetURL: resetURL,
 	}
 }
 
 type Users struct {
-	us      models.UserService
-	signKey []byte
+	us       models.UserService
+	rts      models.RefreshTokenService
+	mailer   mail.Sender
+	signKey  []byte
+	resetURL string
 }
 
+// Registers a new account.  Everyone signs up as a student; only an admin
+// can give an account another role, through SetRole.
 func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	form := UsersCreateForm{}
 	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
@@ -29,7 +47,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 
 	user := models.User{
 		Name:          form.Name,
-		UserType:      form.UserType,
+		UserType:      models.RoleStudent,
 		Email:         form.Email,
 		Password:      form.Password,
 		PasswordReset: false,
@@ -45,34 +63,25 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	tokenString, err := u.createUserJWT(&user)
+	rt, err := u.rts.Issue(user.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	user.PasswordHash = ""
-	URF := UsersReturnForm{
-		User:  user,
-		Token: tokenString,
-	}
-
-	if err := json.NewEncoder(w).Encode(&URF); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	u.sendTokens(w, &user, rt)
 }
 
 type UsersCreateForm struct {
 	Name     string `json:"Name,omitempty"`
 	Email    string `json:"Email,omitempty"`
 	Password string `json:"Password,omitempty"`
-	UserType string `json:"UserType,omitempty"`
 }
 
 type UsersReturnForm struct {
-	User  models.User
-	Token string
+	User         models.User
+	Token        string
+	ExpiresAt    int64
+	RefreshToken string
 }
 
 func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
@@ -93,45 +102,262 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	tokenString, err := u.createUserJWT(user)
+	rt, err := u.rts.Issue(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.sendTokens(w, user, rt)
+}
+
+type LoginForm struct {
+	Email    string `json:"Email,omitempty"`
+	Password string `json:"Password,omitempty"`
+}
+
+// Trades a refresh token for a new access token and refresh token.  The old
+// refresh token cannot be used again.
+func (u *Users) Refresh(w http.ResponseWriter, r *http.Request) {
+	form := RefreshForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rt, err := u.rts.Rotate(form.RefreshToken)
+	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusUnauthorized)
+			return
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	user, err := u.us.ByID(rt.UserID)
+	if err != nil {
+		if err == models.ErrIDInvalid {
+			http.Error(w, "User no longer exists", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.sendTokens(w, user, rt)
+}
+
+type RefreshForm struct {
+	RefreshToken string `json:"RefreshToken,omitempty"`
+}
+
+// Ends the session the access token belongs to, or every session the user has
+// when All is set.  Tokens from ended sessions are rejected by the middleware
+// straight away.
+func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	form := LogoutForm{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	if form.All {
+		err = u.rts.RevokeUser(claims.UserID)
+	} else {
+		err = u.rts.RevokeSession(claims.Id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type LogoutForm struct {
+	All bool `json:"All,omitempty"`
+}
+
+// Changes the role of a user.  Only admins can do this.  Every session the
+// user had is ended, so tokens carrying the old role stop working straight
+// away.
+func (u *Users) SetRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
 	if err != nil {
+		http.Error(w, errInvalidID.Error(), http.StatusBadRequest)
+		return
+	}
+	form := RoleForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := u.us.ByID(uint(id))
+	if err != nil {
+		if err == models.ErrIDInvalid {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if strings.TrimSpace(form.Role) == "" {
+		http.Error(w, models.ErrUserTypeInvalid.Public(), http.StatusNotAcceptable)
+		return
+	}
+	user.UserType = form.Role
+	if err := u.us.Update(user); err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := u.rts.RevokeUser(user.ID); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	user.PasswordHash = ""
-	URF := UsersReturnForm{
-		User:  *user,
-		Token: tokenString,
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+}
 
-	if err := json.NewEncoder(w).Encode(&URF); err != nil {
+type RoleForm struct {
+	Role string `json:"Role,omitempty"`
+}
+
+// Starts a password reset and mails the reset link to the user.  The response
+// is the same whether or not the email belongs to an account, so this cannot
+// be used to find out who is registered.
+func (u *Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	form := ForgotPasswordForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := u.us.InitiateReset(form.Email)
+	switch err {
+	case nil:
+	case models.ErrEmailNotFound, models.ErrEmailInvalid:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	msg := mail.Message{
+		To:      strings.ToLower(strings.TrimSpace(form.Email)),
+		Subject: "Reset your Intellicast password",
+		Body: "Someone asked to reset the password for your Intellicast account.\n\n" +
+			"Use this link within the next hour to choose a new one:\n\n" +
+			u.resetURL + token + "\n\n" +
+			"If this was not you, you can ignore this email.\n",
+	}
+	// A failure is only logged; answering differently here would give away
+	// that the email belongs to an account
+	if err := u.mailer.Send(msg); err != nil {
+		log.Println("Could not send password reset mail:", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
 }
 
-type LoginForm struct {
-	Email    string `json:"Email,omitempty"`
+type ForgotPasswordForm struct {
+	Email string `json:"Email,omitempty"`
+}
+
+// Sets a new password using a token from ForgotPassword.  Every session the
+// user had is ended, so they have to log in again everywhere.
+func (u *Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	form := ResetPasswordForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := u.us.CompleteReset(form.Token, form.Password)
+	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := u.rts.RevokeUser(user.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ResetPasswordForm struct {
+	Token    string `json:"Token,omitempty"`
 	Password string `json:"Password,omitempty"`
 }
 
+// sendTokens signs an access token for the refresh token's session and writes
+// both back to the client along with the user.
+func (u *Users) sendTokens(w http.ResponseWriter, user *models.User, rt *models.RefreshToken) {
+	expiresAt := time.Now().Add(AccessTokenDuration)
+	tokenString, err := u.createUserJWT(user, rt.SessionID, expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user.PasswordHash = ""
+	URF := UsersReturnForm{
+		User:         *user,
+		Token:        tokenString,
+		ExpiresAt:    expiresAt.Unix(),
+		RefreshToken: rt.Token,
+	}
+
+	if err := json.NewEncoder(w).Encode(&URF); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 // form to send back JWT token
 type Token struct {
 	Token string `json:"token"`
 }
 
 // Takes user information and creates a JWT token with it, and signs the token
-// with signKey.  Errors should never occur here, but if they do, then our app
-// is in a really bad state.  Returns JWT token and nil
-func (u *Users) createUserJWT(user *models.User) (string, error) {
+// with signKey.  The session ID goes in the jti claim so the middleware can
+// reject tokens from sessions that were logged out.  Errors should never occur
+// here, but if they do, then our app is in a really bad state.  Returns JWT
+// token and nil
+func (u *Users) createUserJWT(user *models.User, sessionID string, expiresAt time.Time) (string, error) {
 	// Create claims for the jwt
 	claims := Claims{
 		user.Email,
 		user.ID,
+		user.UserType,
 		jwt.StandardClaims{
-			// ExpiresAt: time.Now().Add(time.Minute * 20).Unix(),
-			Issuer: "user",
+			ExpiresAt: expiresAt.Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Id:        sessionID,
+			Issuer:    "user",
 		},
 	}
 
@@ -152,28 +378,33 @@ func (u *Users) createUserJWT(user *models.User) (string, error) {
 type Claims struct {
 	UserEmail string `json:"user_email,omitempty"`
 	UserID    uint   `json:"user_id,omitempty"`
+	UserType  string `json:"user_type,omitempty"`
 	jwt.StandardClaims
 }
 
 // Used on app open to check if a user is valid.  Middleware jwt should take
 // care of everything, as jwt must be checked before this runs.
-// Also sends back an array of user materials the user can send with the app.
+// Sends back the profile of the user the token belongs to.
 func (u *Users) Check(w http.ResponseWriter, r *http.Request) {
-	// claims := r.Context().Value("user_claims").(*Claims)
-	// user, err := u.us.ByID(claims.UserID)
-	// if err != nil {
-	// 	if pErr, ok := err.(PublicError); ok {
-	// 		http.Error(w, pErr.Public(), http.StatusNotFound)
-	// 		return
-	// 	} else {
-	// 		http.Error(w, err.Error(), http.StatusInternalServerError)
-	// 		return
-	// 	}
-	// }
-	// resp, err := json.Marshal(user.MaterialTypes)
-	// if err != nil {
-	// 	http.Error(w, err.Error(), http.StatusInternalServerError)
-	// }
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	user, err := u.us.ByID(claims.UserID)
+	if err != nil {
+		if err == models.ErrIDInvalid {
+			http.Error(w, "User no longer exists", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user.PasswordHash = ""
 	w.Header().Set("Content-Type", "application/json")
-	// w.Write(resp)
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
@@ -0,0 +1,430 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/captions"
+	"github.com/TerrenceHo/CalHacks4-Backend/models"
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
+	"github.com/gorilla/mux"
+)
+
+func NewVideos(videos models.VideoService, transcripts models.TranscriptService, occurrences models.TopicOccurrenceService, related models.RelatedService, classes models.ClassService, enrollments models.EnrollmentService, store storage.BlobStore, ttl time.Duration, keyPrefix string) *Videos {
+	return &Videos{
+		classAccess: classAccess{
+			cs: classes,
+			es: enrollments,
+		},
+		vs:    videos,
+		ts:    transcripts,
+		tos:   occurrences,
+		rs:    related,
+		media: media{store, ttl, keyPrefix},
+	}
+}
+
+// Videos serves single lectures.  Everything a video allows is decided by the
+// class it belongs to.
+type Videos struct {
+	classAccess
+	media
+	vs  models.VideoService
+	ts  models.TranscriptService
+	tos models.TopicOccurrenceService
+	rs  models.RelatedService
+}
+
+// Sends back a single video to users who can see its class.
+func (v *Videos) Get(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := v.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !v.authorizeView(w, r, video.ClassID) {
+		return
+	}
+
+	v.signVideo(video)
+	if err := json.NewEncoder(w).Encode(video); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Sends back a fresh signed link to a video's recording, for the app to ask
+// for when the one it was given is about to expire.
+func (v *Videos) Playback(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := v.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !v.authorizeView(w, r, video.ClassID) {
+		return
+	}
+
+	link := v.playbackLink(video)
+	if err := json.NewEncoder(w).Encode(&link); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Streams a video's recording to users who can see its class.  Recordings in
+// local storage are served by the server itself, with byte ranges so
+// players can seek; the rest are redirected to a signed link.
+func (v *Videos) Media(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := v.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !v.authorizeView(w, r, video.ClassID) {
+		return
+	}
+
+	if local, ok := v.store.(*storage.Local); ok && v.owns(video.ClassID, video.ObjectKey) {
+		serveFile(w, r, local, video.ObjectKey)
+		return
+	}
+	link := v.playbackLink(video)
+	if link.URL == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, link.URL, http.StatusFound)
+}
+
+// Sends back the lectures most like a video, judged by their shared topics
+// and the words of their transcripts.  Lectures of every class the user can
+// see are considered; scope=class keeps to the video's own class.  limit caps
+// how many come back.
+func (v *Videos) Related(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := v.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !v.authorizeView(w, r, video.ClassID) {
+		return
+	}
+	claims, _ := ClaimsFromContext(r.Context())
+
+	q := r.URL.Query()
+	limit, err := parseIntParam(q.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	classIDs := []uint{video.ClassID}
+	switch q.Get("scope") {
+	case "", "all":
+		classes, err := v.viewableClasses(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, class := range classes {
+			if class.ID != video.ClassID {
+				classIDs = append(classIDs, class.ID)
+			}
+		}
+	case "class":
+	default:
+		http.Error(w, "scope must be class or all", http.StatusBadRequest)
+		return
+	}
+
+	related, err := v.rs.Related(video, classIDs, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range related {
+		v.signVideo(&related[i].Video)
+	}
+	if err := json.NewEncoder(w).Encode(&related); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Replaces the URL, lecture details, topics and related resources of a
+// video.  Instructors of its class and admins can do this.
+func (v *Videos) Update(w http.ResponseWriter, r *http.Request) {
+	video, class, ok := v.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !v.authorizeEdit(w, r, class) {
+		return
+	}
+
+	form := VideoUpdateForm{}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	video.URL = form.URL
+	video.Title = form.Title
+	video.Description = form.Description
+	video.Sequence = form.Sequence
+	video.RecordedAt = form.RecordedAt
+	video.DurationSeconds = form.DurationSeconds
+	video.ThumbnailURL = form.ThumbnailURL
+	video.Topics = form.Topics.Names()
+	video.Related_Resources = form.Related_Resources
+	if form.Status != "" {
+		video.Status = form.Status
+	}
+
+	// The timestamps are checked before anything is saved, so bad ones
+	// never leave the video changed without them
+	occurrences := form.Topics.Occurrences()
+	if err := v.tos.Check(occurrences); err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := v.vs.Update(video); err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// New timestamps replace the old ones; otherwise only the timestamps of
+	// topics that were removed are dropped
+	var err error
+	if len(occurrences) > 0 {
+		err = v.tos.ReplaceForVideo(video.ID, occurrences)
+	} else {
+		err = v.tos.KeepTopics(video.ID, video.Topics)
+	}
+	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusNotAcceptable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(video); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type VideoUpdateForm struct {
+	URL               string     `json:"URL,omitempty"`
+	Title             string     `json:"Title,omitempty"`
+	Description       string     `json:"Description,omitempty"`
+	Sequence          int        `json:"Sequence,omitempty"`
+	RecordedAt        *time.Time `json:"RecordedAt,omitempty"`
+	DurationSeconds   int        `json:"DurationSeconds,omitempty"`
+	ThumbnailURL      string     `json:"ThumbnailURL,omitempty"`
+	Topics            TopicsForm `json:"Topics,omitempty"`
+	Related_Resources []string   `json:"Related_Resources,omitempty"`
+	// Status is left as it was when not given.
+	Status string `json:"Status,omitempty"`
+}
+
+// Deletes a video.  Instructors of its class and admins can do this.
+func (v *Videos) Delete(w http.ResponseWriter, r *http.Request) {
+	video, class, ok := v.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !v.authorizeEdit(w, r, class) {
+		return
+	}
+
+	if err := v.vs.Delete(video.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sends back every moment a topic comes up in a video, in time order.
+func (v *Videos) Topics(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := v.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !v.authorizeView(w, r, video.ClassID) {
+		return
+	}
+
+	occurrences, err := v.tos.ByVideo(video.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(&occurrences); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Sends back the transcript of a video, a page at a time.  Query parameters:
+//
+//	offset, limit  page through the segments (limit defaults to 100, max 500)
+//	from_ms, to_ms only return segments overlapping this time window
+func (v *Videos) Transcript(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := v.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !v.authorizeView(w, r, video.ClassID) {
+		return
+	}
+
+	q := r.URL.Query()
+	opts := models.TranscriptOptions{}
+	var err error
+	if opts.Offset, err = parseIntParam(q.Get("offset")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Limit, err = parseIntParam(q.Get("limit")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.FromMS, err = parseMillisParam(q.Get("from_ms")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.ToMS, err = parseMillisParam(q.Get("to_ms")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	segments, total, err := v.ts.ByVideo(video.ID, opts)
+	if err != nil {
+		if pErr, ok := err.(PublicError); ok {
+			http.Error(w, pErr.Public(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := TranscriptPage{
+		VideoID:  video.ID,
+		Total:    total,
+		Offset:   opts.Offset,
+		Segments: segments,
+	}
+	if err := json.NewEncoder(w).Encode(&page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type TranscriptPage struct {
+	VideoID  uint
+	Total    int
+	Offset   int
+	Segments []models.TranscriptSegment
+}
+
+// Sends back the transcript of a video as WebVTT captions.
+func (v *Videos) CaptionsVTT(w http.ResponseWriter, r *http.Request) {
+	v.captions(w, r, "text/vtt; charset=utf-8", "vtt", captions.WriteVTT)
+}
+
+// Sends back the transcript of a video as SubRip captions.
+func (v *Videos) CaptionsSRT(w http.ResponseWriter, r *http.Request) {
+	v.captions(w, r, "application/x-subrip; charset=utf-8", "srt", captions.WriteSRT)
+}
+
+func (v *Videos) captions(w http.ResponseWriter, r *http.Request, contentType, ext string, write func(io.Writer, []captions.Cue) error) {
+	video, _, ok := v.videoFromVars(w, r)
+	if !ok {
+		return
+	}
+	if !v.authorizeView(w, r, video.ClassID) {
+		return
+	}
+
+	segments, err := v.ts.AllByVideo(video.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cues := make([]captions.Cue, len(segments))
+	for i, seg := range segments {
+		cues[i] = captions.Cue{
+			Start: time.Duration(seg.StartMS) * time.Millisecond,
+			End:   time.Duration(seg.EndMS) * time.Millisecond,
+			Text:  seg.Text,
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := write(&buf, cues); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="video-%d.%s"`, video.ID, ext))
+	w.Write(buf.Bytes())
+}
+
+// videoFromVars loads the video named by the {id} path variable and the class
+// it belongs to, writing an error response and returning false if it cannot.
+func (v *Videos) videoFromVars(w http.ResponseWriter, r *http.Request) (*models.Video, *models.Class, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, errInvalidID.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return loadVideo(w, v.vs, v.cs, uint(id))
+}
+
+// loadVideo looks up a video and its class, writing an error response and
+// returning false if either is missing.  Videos of deleted classes are
+// treated as missing.
+func loadVideo(w http.ResponseWriter, vs models.VideoService, cs models.ClassService, id uint) (*models.Video, *models.Class, bool) {
+	video, err := vs.ByID(id)
+	if err != nil {
+		if err == models.ErrVideoNotFound {
+			http.Error(w, models.ErrVideoNotFound.Public(), http.StatusNotFound)
+			return nil, nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	class, err := cs.GetClassByID(video.ClassID)
+	if err != nil {
+		if err == models.ErrClassNotFound {
+			http.Error(w, models.ErrVideoNotFound.Public(), http.StatusNotFound)
+			return nil, nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return video, class, true
+}
+
+func parseMillisParam(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a positive number of milliseconds", s)
+	}
+	return n, nil
+}
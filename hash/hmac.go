@@ -0,0 +1,40 @@
+package hash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// NewHMAC creates and returns a new HMAC object
+func NewHMAC(key string) HMAC {
+	return HMAC{
+		key: []byte(key),
+	}
+}
+
+// HMAC is a wrapper around the crypto/hmac package making it a little easier
+// to use in our code.  A fresh hash is created on every call so an HMAC can be
+// shared between goroutines.
+type HMAC struct {
+	key []byte
+}
+
+// Hash will hash the provided input string using HMAC with the secret key
+// provided when the HMAC object was created
+func (h HMAC) Hash(input string) string {
+	b := h.Sum([]byte(input))
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// Sum returns the raw HMAC-SHA256 of input.
+func (h HMAC) Sum(input []byte) []byte {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+// Equal compares two MACs in constant time.
+func Equal(a, b []byte) bool {
+	return hmac.Equal(a, b)
+}
@@ -0,0 +1,115 @@
+// Package hls writes HTTP Live Streaming playlists: master playlists listing
+// the renditions of a video, and media playlists listing the segments of
+// one rendition.
+package hls
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ContentType is the media type of every playlist.
+const ContentType = "application/vnd.apple.mpegurl"
+
+// version 3 is the first to allow segment durations with fractions of a
+// second, and the newest every player supports.
+const version = 3
+
+// ErrURIInvalid is returned for a playlist entry whose URI is empty or
+// would break the line it is written on.
+var ErrURIInvalid = errors.New("hls: URI must not be empty or contain line breaks")
+
+// Variant is one rendition of a video in a master playlist.  Bandwidth is
+// its peak bits per second; the other attributes are left out when zero.
+type Variant struct {
+	URI              string
+	Bandwidth        int
+	AverageBandwidth int
+	Width            int
+	Height           int
+	Codecs           string
+	FrameRate        float64
+}
+
+// Segment is one piece of a rendition in a media playlist.
+type Segment struct {
+	URI      string
+	Duration time.Duration
+}
+
+// WriteMaster writes a master playlist listing variants from the lowest
+// bandwidth to the highest, the order players try them in.  Nothing is
+// written if any URI is invalid.
+func WriteMaster(w io.Writer, variants []Variant) error {
+	for _, v := range variants {
+		if !validURI(v.URI) {
+			return ErrURIInvalid
+		}
+	}
+	sorted := append([]Variant(nil), variants...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Bandwidth < sorted[j].Bandwidth
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n", version)
+	for _, v := range sorted {
+		attrs := []string{fmt.Sprintf("BANDWIDTH=%d", v.Bandwidth)}
+		if v.AverageBandwidth > 0 {
+			attrs = append(attrs, fmt.Sprintf("AVERAGE-BANDWIDTH=%d", v.AverageBandwidth))
+		}
+		if v.Width > 0 && v.Height > 0 {
+			attrs = append(attrs, fmt.Sprintf("RESOLUTION=%dx%d", v.Width, v.Height))
+		}
+		if v.FrameRate > 0 {
+			attrs = append(attrs, fmt.Sprintf("FRAME-RATE=%.3f", v.FrameRate))
+		}
+		if v.Codecs != "" {
+			attrs = append(attrs, fmt.Sprintf("CODECS=%q", v.Codecs))
+		}
+		fmt.Fprintf(bw, "#EXT-X-STREAM-INF:%s\n%s\n", strings.Join(attrs, ","), v.URI)
+	}
+	return bw.Flush()
+}
+
+// WriteMedia writes a complete, video on demand media playlist of segments
+// in the order given.  Nothing is written if any URI is invalid.
+func WriteMedia(w io.Writer, segments []Segment) error {
+	for _, s := range segments {
+		if !validURI(s.URI) {
+			return ErrURIInvalid
+		}
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "#EXTM3U\n#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(bw, "#EXT-X-TARGETDURATION:%d\n", TargetDuration(segments))
+	bw.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for _, s := range segments {
+		fmt.Fprintf(bw, "#EXTINF:%.3f,\n%s\n", s.Duration.Seconds(), s.URI)
+	}
+	bw.WriteString("#EXT-X-ENDLIST\n")
+	return bw.Flush()
+}
+
+// TargetDuration is the longest segment's duration rounded to the nearest
+// second, which the spec requires every segment to fit within, and at
+// least one.
+func TargetDuration(segments []Segment) int {
+	target := 1
+	for _, s := range segments {
+		if d := int(math.Floor(s.Duration.Seconds() + 0.5)); d > target {
+			target = d
+		}
+	}
+	return target
+}
+
+func validURI(uri string) bool {
+	return uri != "" && !strings.ContainsAny(uri, "\r\n")
+}
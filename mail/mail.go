@@ -0,0 +1,88 @@
+package mail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers email.  Which implementation is used is picked in the
+// config, so development servers never need a real mail server.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// LogSender writes every message to the standard logger instead of sending
+// it.
+type LogSender struct{}
+
+func (LogSender) Send(msg Message) error {
+	log.Printf("mail: to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileSender writes every message as an .eml file in Dir.
+type FileSender struct {
+	Dir  string
+	From string
+}
+
+func (fs FileSender) Send(msg Message) error {
+	if err := os.MkdirAll(fs.Dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitize(msg.To))
+	return ioutil.WriteFile(filepath.Join(fs.Dir, name), format(fs.From, msg), 0600)
+}
+
+// SMTPSender sends messages through an SMTP server using PLAIN auth.
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (ss SMTPSender) Send(msg Message) error {
+	var auth smtp.Auth
+	if ss.Username != "" {
+		auth = smtp.PlainAuth("", ss.Username, ss.Password, ss.Host)
+	}
+	return smtp.SendMail(ss.Host+":"+ss.Port, auth, ss.From, []string{msg.To}, format(ss.From, msg))
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+	return []byte(b.String())
+}
+
+// sanitize keeps an email address safe to use in a file name.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_', r == '@':
+			return r
+		}
+		return '_'
+	}, s)
+}
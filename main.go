@@ -4,41 +4,124 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/TerrenceHo/CalHacks4-Backend/config"
 	"github.com/TerrenceHo/CalHacks4-Backend/controllers"
+	"github.com/TerrenceHo/CalHacks4-Backend/mail"
+	"github.com/TerrenceHo/CalHacks4-Backend/middleware"
 	"github.com/TerrenceHo/CalHacks4-Backend/models"
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
 	"github.com/gorilla/mux"
 )
 
 func main() {
 	cfg := config.LoadConfig()
+	store := newBlobStore(cfg.Storage)
 	// connection := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable", host, port, user, name)
 	services, err := models.NewServices(
 		models.WithGorm(cfg.DatabaseDialect(), cfg.DatabaseConnectionInfo()),
 		models.WithLogMode(!cfg.IsProd()),
-		models.WithUser(cfg.Pepper),
+		models.WithUser(cfg.Pepper, cfg.PassResetSecret),
+		models.WithRefreshToken(cfg.HMACKey),
 		models.WithClass(),
-		models.WithVideo(),
+		models.WithEnrollment(),
+		models.WithVideo(cfg.Search.SimilarityThreshold, store, cfg.Upload.KeyPrefix),
+		models.WithTranscript(),
+		models.WithTopicOccurrence(),
+		models.WithSearch(),
+		models.WithClassTopic(),
+		models.WithRelated(),
+		models.WithResource(),
+		models.WithUpload(cfg.Upload.MaxSizeMB<<20, cfg.Upload.Types),
+		models.WithRendition(cfg.Upload.KeyPrefix),
 	)
 	must(err)
 	defer services.Close()
 	err = services.AutoMigrate()
 	must(err)
 
-	usersC := controllers.NewUsers(services.User, cfg.SignKey)
-	classesC := controllers.NewClasses(services.Class, services.Video)
+	usersC := controllers.NewUsers(services.User, services.RefreshToken, newMailSender(cfg.Mail), cfg.SignKey, cfg.ResetURL)
+	classesC := controllers.NewClasses(services.Class, services.Enrollment, services.Video, services.Transcript, services.Topic, services.ClassTopic, store, cfg.Storage.TTL, cfg.Upload.KeyPrefix)
+	videosC := controllers.NewVideos(services.Video, services.Transcript, services.Topic, services.Related, services.Class, services.Enrollment, store, cfg.Storage.TTL, cfg.Upload.KeyPrefix)
+	resourcesC := controllers.NewResources(services.Resource, services.Video, services.Class, services.Enrollment, store, cfg.Storage.TTL, cfg.Upload.KeyPrefix)
+	uploadsC := controllers.NewUploads(services.Upload, services.Video, services.Class, services.Enrollment, store, cfg.Upload.Dir, cfg.Upload.KeyPrefix)
+	go sweepUploads(uploadsC, cfg.Upload.Expiry)
+	renditionsC := controllers.NewRenditions(services.Rendition, services.Video, services.Class, services.Enrollment, store, cfg.Storage.TTL, cfg.Upload.KeyPrefix)
+	searchC := controllers.NewSearch(services.Search, services.Class, services.Enrollment, store, cfg.Storage.TTL, cfg.Upload.KeyPrefix)
+
+	requireJWT := middleware.NewRequireJWT(cfg, services.RefreshToken)
+	instructors := middleware.AllowRoles(models.RoleProfessor, models.RoleAdmin)
+	admins := middleware.AllowRoles(models.RoleAdmin)
+	anyUser := middleware.AllowAuthenticated
 
 	router := mux.NewRouter()
 	router.HandleFunc("/", homePage).Methods("GET")
-	router.HandleFunc("/api/v1/user/register", usersC.Create).Methods("POST")
-	router.HandleFunc("/api/v1/user/login", usersC.Login).Methods("POST")
+	// Locally stored media is served to anyone with a signed link to it
+	if local, ok := store.(*storage.Local); ok {
+		mediaC := controllers.NewMedia(local)
+		router.HandleFunc("/media/{key:.+}", mediaC.Serve).Methods("GET", "HEAD")
+	}
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/user/register", usersC.Create).Methods("POST")
+	api.HandleFunc("/user/login", usersC.Login).Methods("POST")
+	api.HandleFunc("/user/refresh", usersC.Refresh).Methods("POST")
+	api.HandleFunc("/user/password/forgot", usersC.ForgotPassword).Methods("POST")
+	api.HandleFunc("/user/password/reset", usersC.ResetPassword).Methods("POST")
+	api.HandleFunc("/classes", classesC.GetAllClasses).Methods("GET")
+
+	// Everything below requires a valid JWT
+	authAPI := requireJWT.Group(api)
+	authAPI.HandleFunc("/user/me", anyUser, usersC.Check).Methods("GET")
+	authAPI.HandleFunc("/user/logout", anyUser, usersC.Logout).Methods("POST")
+	authAPI.HandleFunc("/user/classes", anyUser, classesC.MyClasses).Methods("GET")
+	authAPI.HandleFunc("/users/{id:[0-9]+}/role", admins, usersC.SetRole).Methods("PUT")
 
-	router.HandleFunc("/api/v1/classes", classesC.GetAllClasses).Methods("GET")
-	router.HandleFunc("/api/v1/classes/{id}", classesC.GetClass).Methods("GET")
-	router.HandleFunc("/api/v1/classes/create", classesC.Create).Methods("POST")
-	router.HandleFunc("/api/v1/classes/upload", classesC.Upload).Methods("POST")
-	router.HandleFunc("/api/v1/classes/search", classesC.GetByKeyword).Methods("POST")
+	authAPI.HandleFunc("/classes/{id}", anyUser, classesC.GetClass).Methods("GET")
+	authAPI.HandleFunc("/classes/create", instructors, classesC.Create).Methods("POST")
+	authAPI.HandleFunc("/classes/upload", instructors, classesC.Upload).Methods("POST")
+	authAPI.HandleFunc("/classes/search", anyUser, classesC.GetByKeyword).Methods("POST")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}", instructors, classesC.Update).Methods("PUT")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}", instructors, classesC.Delete).Methods("DELETE")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/restore", instructors, classesC.Restore).Methods("POST")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/instructors", instructors, classesC.AddInstructor).Methods("POST")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/instructors/{userID:[0-9]+}", instructors, classesC.RemoveInstructor).Methods("DELETE")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/tas", instructors, classesC.AddTA).Methods("POST")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/topics", anyUser, classesC.TopicMap).Methods("GET")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/topics/suggest", anyUser, classesC.SuggestTopics).Methods("GET")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/topics/similar", anyUser, classesC.SimilarTopics).Methods("GET")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/videos", instructors, uploadsC.Direct).Methods("POST")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/uploads", instructors, uploadsC.Create).Methods("POST")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/enroll", anyUser, classesC.Enroll).Methods("POST")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/enroll", anyUser, classesC.Drop).Methods("DELETE")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/enroll/code", instructors, classesC.EnrollCode).Methods("GET")
+	authAPI.HandleFunc("/classes/{id:[0-9]+}/enroll/code", instructors, classesC.ResetEnrollCode).Methods("POST")
+
+	authAPI.HandleFunc("/videos/{id:[0-9]+}", anyUser, videosC.Get).Methods("GET")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}", instructors, videosC.Update).Methods("PUT")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}", instructors, videosC.Delete).Methods("DELETE")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/playback", anyUser, videosC.Playback).Methods("GET")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/media", anyUser, videosC.Media).Methods("GET", "HEAD")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/hls/master.m3u8", anyUser, renditionsC.Master).Methods("GET")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/hls/{rendition:[0-9]+}.m3u8", anyUser, renditionsC.Media).Methods("GET")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/renditions", instructors, renditionsC.Create).Methods("POST")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/renditions/{rendition:[0-9]+}", instructors, renditionsC.Delete).Methods("DELETE")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/related", anyUser, videosC.Related).Methods("GET")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/resources", anyUser, resourcesC.ByVideo).Methods("GET")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/resources", anyUser, resourcesC.Create).Methods("POST")
+	authAPI.HandleFunc("/resources/{id:[0-9]+}", anyUser, resourcesC.Update).Methods("PUT")
+	authAPI.HandleFunc("/resources/{id:[0-9]+}", anyUser, resourcesC.Delete).Methods("DELETE")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/topics", anyUser, videosC.Topics).Methods("GET")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/transcript", anyUser, videosC.Transcript).Methods("GET")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/captions.vtt", anyUser, videosC.CaptionsVTT).Methods("GET")
+	authAPI.HandleFunc("/videos/{id:[0-9]+}/captions.srt", anyUser, videosC.CaptionsSRT).Methods("GET")
+
+	authAPI.HandleFunc("/uploads/{id:[0-9]+}", instructors, uploadsC.Status).Methods("GET", "HEAD")
+	authAPI.HandleFunc("/uploads/{id:[0-9]+}", instructors, uploadsC.Append).Methods("PATCH")
+	authAPI.HandleFunc("/uploads/{id:[0-9]+}", instructors, uploadsC.Delete).Methods("DELETE")
+
+	authAPI.HandleFunc("/search", anyUser, searchC.Search).Methods("GET")
 
 	log.Println("Listening on Port", cfg.Port)
 	log.Fatal(http.ListenAndServe(":"+cfg.Port, router))
@@ -48,6 +131,67 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "<h1>Hello World!</h1>")
 }
 
+// sweepUploads throws away abandoned uploads now and every hour after.
+func sweepUploads(uploads *controllers.Uploads, expiry time.Duration) {
+	for {
+		if err := uploads.Sweep(time.Now().Add(-expiry)); err != nil {
+			log.Println("Could not sweep abandoned uploads:", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// newMailSender builds the mail.Sender picked in the config.  The config
+// only allows "log" once file and smtp are ruled out.
+func newMailSender(mc config.MailConfig) mail.Sender {
+	switch mc.Sender {
+	case "file":
+		return mail.FileSender{Dir: mc.Dir, From: mc.From}
+	case "smtp":
+		return mail.SMTPSender{
+			Host:     mc.Host,
+			Port:     mc.Port,
+			Username: mc.Username,
+			Password: mc.Password,
+			From:     mc.From,
+		}
+	default:
+		return mail.LogSender{}
+	}
+}
+
+// newBlobStore builds the storage.BlobStore picked in the config, GCS by
+// default.
+func newBlobStore(sc config.StorageConfig) storage.BlobStore {
+	switch sc.Backend {
+	case "s3":
+		return &storage.S3{
+			Endpoint:  sc.Endpoint,
+			Region:    sc.Region,
+			Bucket:    sc.Bucket,
+			AccessKey: sc.AccessKey,
+			SecretKey: sc.SecretKey,
+			PathStyle: sc.PathStyle,
+			Public:    sc.Public,
+			PublicURL: sc.PublicURL,
+		}
+	case "local":
+		return &storage.Local{
+			Dir:        sc.Dir,
+			BaseURL:    sc.PublicURL,
+			SigningKey: []byte(sc.SigningKey),
+		}
+	default:
+		return &storage.GCS{
+			Bucket:    sc.Bucket,
+			AccessKey: sc.AccessKey,
+			SecretKey: sc.SecretKey,
+			Public:    sc.Public,
+			Endpoint:  sc.Endpoint,
+		}
+	}
+}
+
 func must(err error) {
 	if err != nil {
 		panic(err)
@@ -1,61 +1,93 @@
 package middleware
 
 import (
-	"context"
+	"crypto/rsa"
+	"errors"
+	"log"
 	"net/http"
+	"strings"
 
 	"github.com/TerrenceHo/CalHacks4-Backend/config"
 	"github.com/TerrenceHo/CalHacks4-Backend/controllers"
+	"github.com/TerrenceHo/CalHacks4-Backend/models"
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/dgrijalva/jwt-go/request"
 )
 
+var errNoBearerToken = errors.New("middleware: no bearer token in Authorization header")
+
 type RequireJWT struct {
 	VerifyKey []byte
 	SignKey   []byte
+
+	verifyKeyRSA *rsa.PublicKey
+	rts          models.RefreshTokenService
 }
 
-func NewRequireJWT(conf *config.Config) *RequireJWT {
+func NewRequireJWT(conf *config.Config, refreshTokens models.RefreshTokenService) *RequireJWT {
+	verifyKeyRSA, err := jwt.ParseRSAPublicKeyFromPEM(conf.VerifyKey)
+	if err != nil {
+		log.Fatal("Error parsing public key:", err)
+	}
 	return &RequireJWT{
-		VerifyKey: conf.VerifyKey,
-		SignKey:   conf.SignKey,
+		VerifyKey:    conf.VerifyKey,
+		SignKey:      conf.SignKey,
+		verifyKeyRSA: verifyKeyRSA,
+		rts:          refreshTokens,
 	}
 }
 
+// AuthMW verifies the bearer token on the request and stores its claims in
+// the request context for next.  Missing, malformed, expired or otherwise
+// invalid tokens are all rejected with a 401, as are tokens whose session has
+// been logged out.
 func (rj *RequireJWT) AuthMW(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		claims := controllers.Claims{}
-		token, err := request.ParseFromRequestWithClaims(r, request.AuthorizationHeaderExtractor, &claims, func(token *jwt.Token) (interface{}, error) {
-			verifyKeyRSA, err := jwt.ParseRSAPublicKeyFromPEM(rj.VerifyKey)
-			if err != nil {
-				panic(err)
-			}
-			return verifyKeyRSA, nil
-		})
+		tokenString, err := bearerToken(r)
 		if err != nil {
-			switch err.(type) {
-			case *jwt.ValidationError:
-				vErr := err.(*jwt.ValidationError)
-				switch vErr.Errors {
-				case jwt.ValidationErrorExpired:
-					http.Error(w, err.Error(), http.StatusUnauthorized)
-					return
-				default:
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			default:
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+			http.Error(w, "Missing or malformed Authorization header", http.StatusUnauthorized)
+			return
 		}
 
-		if token.Valid {
-			newRequest := r.WithContext(context.WithValue(r.Context(), "user_claims", &claims))
-			*r = *newRequest
-			next(w, r)
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
+		claims := controllers.Claims{}
+		token, err := jwt.ParseWithClaims(tokenString, &claims, rj.keyFunc)
+		if err != nil || !token.Valid {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		active, err := rj.rts.SessionActive(claims.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !active {
+			http.Error(w, "Session has been revoked", http.StatusUnauthorized)
+			return
 		}
+
+		next(w, r.WithContext(controllers.WithClaims(r.Context(), &claims)))
 	})
 }
+
+// keyFunc hands the RSA public key to the jwt parser, refusing tokens signed
+// with anything other than RSA so an attacker cannot switch algorithms.
+func (rj *RequireJWT) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, jwt.ErrInvalidKeyType
+	}
+	return rj.verifyKeyRSA, nil
+}
+
+// bearerToken pulls the token out of an "Authorization: Bearer <token>"
+// header.
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", errNoBearerToken
+	}
+	token := strings.TrimSpace(header[7:])
+	if token == "" {
+		return "", errNoBearerToken
+	}
+	return token, nil
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/controllers"
+	"github.com/gorilla/mux"
+)
+
+// Policy decides whether the user described by claims may use a route.
+type Policy func(claims *controllers.Claims) bool
+
+// AllowRoles returns a Policy that only lets through users whose UserType is
+// one of roles.
+func AllowRoles(roles ...string) Policy {
+	return func(claims *controllers.Claims) bool {
+		for _, role := range roles {
+			if claims.UserType == role {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AllowAuthenticated is a Policy that lets through any user with a valid
+// token.
+func AllowAuthenticated(claims *controllers.Claims) bool {
+	return true
+}
+
+// Authorize requires a valid JWT through AuthMW and then checks the user's
+// claims against policy before calling next.  Users who fail the policy get a
+// 403.
+func (rj *RequireJWT) Authorize(policy Policy, next http.HandlerFunc) http.HandlerFunc {
+	return rj.AuthMW(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := controllers.ClaimsFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !policy(claims) {
+			http.Error(w, "You do not have permission to access this resource", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Group registers routes on a router that all sit behind RequireJWT.
+type Group struct {
+	router *mux.Router
+	rj     *RequireJWT
+}
+
+// Group returns a Group that adds authenticated routes to router.
+func (rj *RequireJWT) Group(router *mux.Router) *Group {
+	return &Group{
+		router: router,
+		rj:     rj,
+	}
+}
+
+// HandleFunc registers f at path, only reachable by users passing policy.
+func (g *Group) HandleFunc(path string, policy Policy, f http.HandlerFunc) *mux.Route {
+	return g.router.HandleFunc(path, g.rj.Authorize(policy, f))
+}
@@ -0,0 +1,278 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// DefaultTopicSuggestions is how many topics Suggest returns when no
+	// limit is asked for.
+	DefaultTopicSuggestions = 10
+	// MaxTopicSuggestions is the most topics Suggest returns.
+	MaxTopicSuggestions = 50
+)
+
+// Orders a class's topic map can be listed in.
+const (
+	// TopicOrderFrequency lists the topics covered by the most lectures
+	// first.
+	TopicOrderFrequency = "frequency"
+	// TopicOrderChronology lists topics in the order the class first
+	// covers them.
+	TopicOrderChronology = "chronology"
+)
+
+// ClassTopic is one topic of a class in the topic index, with how many of
+// the class's lectures cover it and the first and last of those lectures.
+// Topics differing only by case are one entry; Normalized is the lower case
+// form they share and Topic the spelling first seen.  The index is derived
+// from Video.Topics and kept up to date by the video service, so it is never
+// written directly.
+//
+// Lectures are put in the same order the class lists them in: by lecture
+// number, then by when they were recorded, or uploaded if the recording date
+// is unknown.
+type ClassTopic struct {
+	ID         uint   `gorm:"primary_key"`
+	ClassID    uint   `gorm:"not null;unique_index:idx_class_topics_class_normalized"`
+	Topic      string `gorm:"type:varchar(200);not null"`
+	Normalized string `gorm:"type:varchar(200);not null;unique_index:idx_class_topics_class_normalized"`
+	VideoCount int    `gorm:"not null"`
+
+	FirstVideoID   uint
+	FirstSequence  int
+	FirstLectureAt time.Time
+	LastVideoID    uint
+	LastSequence   int
+	LastLectureAt  time.Time
+}
+
+type ClassTopicDB interface {
+	// ByClass returns the whole topic map of a class in order, which is
+	// TopicOrderFrequency or TopicOrderChronology.
+	ByClass(classID uint, order string) ([]ClassTopic, error)
+	// Suggest returns the topics of a class starting with prefix, ignoring
+	// case, most covered first.  An empty prefix matches every topic.
+	Suggest(classID uint, prefix string, limit int) ([]ClassTopic, error)
+
+	// AddVideo counts the topics of a newly created video.
+	AddVideo(video *Video) error
+	// Rebuild recounts every topic of a class from its videos, for when
+	// topics are changed or removed.
+	Rebuild(classID uint) error
+}
+
+type ClassTopicService interface {
+	ClassTopicDB
+}
+
+func NewClassTopicService(db *gorm.DB) ClassTopicService {
+	ctg := &classTopicGorm{db}
+	return &classTopicService{
+		ClassTopicDB: newClassTopicValidator(ctg),
+	}
+}
+
+var _ ClassTopicService = &classTopicService{}
+
+type classTopicService struct {
+	ClassTopicDB
+}
+
+var _ ClassTopicDB = &classTopicValidator{}
+
+type classTopicValidator struct {
+	ClassTopicDB
+}
+
+func newClassTopicValidator(ctdb ClassTopicDB) *classTopicValidator {
+	return &classTopicValidator{
+		ClassTopicDB: ctdb,
+	}
+}
+
+func (ctv *classTopicValidator) Suggest(classID uint, prefix string, limit int) ([]ClassTopic, error) {
+	if limit <= 0 {
+		limit = DefaultTopicSuggestions
+	}
+	if limit > MaxTopicSuggestions {
+		limit = MaxTopicSuggestions
+	}
+	return ctv.ClassTopicDB.Suggest(classID, strings.ToLower(strings.TrimSpace(prefix)), limit)
+}
+
+func (ctv *classTopicValidator) ByClass(classID uint, order string) ([]ClassTopic, error) {
+	switch order {
+	case "":
+		order = TopicOrderFrequency
+	case TopicOrderFrequency, TopicOrderChronology:
+	default:
+		return nil, ErrTopicOrderInvalid
+	}
+	return ctv.ClassTopicDB.ByClass(classID, order)
+}
+
+var _ ClassTopicDB = &classTopicGorm{}
+
+type classTopicGorm struct {
+	db *gorm.DB
+}
+
+func (ctg *classTopicGorm) ByClass(classID uint, order string) ([]ClassTopic, error) {
+	db := ctg.db.Where("class_id = ?", classID)
+	if order == TopicOrderChronology {
+		db = db.Order("first_sequence").Order("first_lecture_at").Order("first_video_id")
+	} else {
+		db = db.Order("video_count DESC")
+	}
+	topics := []ClassTopic{}
+	if err := db.Order("normalized").Find(&topics).Error; err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Suggest expects prefix to already be lower case.
+func (ctg *classTopicGorm) Suggest(classID uint, prefix string, limit int) ([]ClassTopic, error) {
+	db := ctg.db.Where("class_id = ?", classID)
+	if prefix != "" {
+		db = db.Where("normalized LIKE ?", likeEscaper.Replace(prefix)+"%")
+	}
+	topics := []ClassTopic{}
+	err := db.Order("video_count DESC").Order("normalized").
+		Limit(limit).
+		Find(&topics).Error
+	if err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// AddVideo relies on the video's topics already being distinct, ignoring
+// case, which the video validator ensures.  The new video replaces the first
+// or last lecture of a topic when it comes before or after it.
+func (ctg *classTopicGorm) AddVideo(video *Video) error {
+	lectureAt := video.CreatedAt
+	if video.RecordedAt != nil {
+		lectureAt = *video.RecordedAt
+	}
+	for _, topic := range video.Topics {
+		err := ctg.db.Exec(`
+			INSERT INTO class_topics (class_id, topic, normalized, video_count,
+				first_video_id, first_sequence, first_lecture_at,
+				last_video_id, last_sequence, last_lecture_at)
+			VALUES (?, ?, ?, 1, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (class_id, normalized)
+			DO UPDATE SET video_count = class_topics.video_count + 1,
+				first_video_id = CASE WHEN `+addedFirst+` THEN EXCLUDED.first_video_id ELSE class_topics.first_video_id END,
+				first_sequence = CASE WHEN `+addedFirst+` THEN EXCLUDED.first_sequence ELSE class_topics.first_sequence END,
+				first_lecture_at = CASE WHEN `+addedFirst+` THEN EXCLUDED.first_lecture_at ELSE class_topics.first_lecture_at END,
+				last_video_id = CASE WHEN `+addedLast+` THEN EXCLUDED.last_video_id ELSE class_topics.last_video_id END,
+				last_sequence = CASE WHEN `+addedLast+` THEN EXCLUDED.last_sequence ELSE class_topics.last_sequence END,
+				last_lecture_at = CASE WHEN `+addedLast+` THEN EXCLUDED.last_lecture_at ELSE class_topics.last_lecture_at END`,
+			video.ClassID, topic, strings.ToLower(topic),
+			video.ID, video.Sequence, lectureAt,
+			video.ID, video.Sequence, lectureAt).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addedFirst and addedLast compare the lecture being added to an existing
+// topic's first and last lectures.
+const (
+	addedFirst = `(EXCLUDED.first_sequence, EXCLUDED.first_lecture_at, EXCLUDED.first_video_id) <
+		(class_topics.first_sequence, class_topics.first_lecture_at, class_topics.first_video_id)`
+	addedLast = `(EXCLUDED.last_sequence, EXCLUDED.last_lecture_at, EXCLUDED.last_video_id) >
+		(class_topics.last_sequence, class_topics.last_lecture_at, class_topics.last_video_id)`
+)
+
+func (ctg *classTopicGorm) Rebuild(classID uint) error {
+	tx := ctg.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := rebuildClassTopics(tx, classID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// rebuildClassTopics counts the topics of a class from scratch within tx.
+func rebuildClassTopics(tx *gorm.DB, classID uint) error {
+	if err := tx.Where("class_id = ?", classID).Delete(&ClassTopic{}).Error; err != nil {
+		return err
+	}
+	return tx.Exec(classTopicCounts+` AND v.class_id = ?`+classTopicGroups, classID).Error
+}
+
+// classTopicCounts and classTopicGroups wrap a filter on videos v to count
+// the topics of every class they belong to.  The first spelling uploaded is
+// the one kept.
+const (
+	classTopicCounts = `
+		INSERT INTO class_topics (class_id, topic, normalized, video_count,
+			first_video_id, first_sequence, first_lecture_at,
+			last_video_id, last_sequence, last_lecture_at)
+		SELECT v.class_id,
+			(array_agg(t.topic ORDER BY v.created_at, v.id))[1],
+			lower(t.topic),
+			count(DISTINCT v.id),
+			(array_agg(v.id ORDER BY ` + lectureOrder + `))[1],
+			(array_agg(v.sequence ORDER BY ` + lectureOrder + `))[1],
+			(array_agg(coalesce(v.recorded_at, v.created_at) ORDER BY ` + lectureOrder + `))[1],
+			(array_agg(v.id ORDER BY ` + lectureOrderDesc + `))[1],
+			(array_agg(v.sequence ORDER BY ` + lectureOrderDesc + `))[1],
+			(array_agg(coalesce(v.recorded_at, v.created_at) ORDER BY ` + lectureOrderDesc + `))[1]
+		FROM videos v, unnest(v.topics) AS t(topic)
+		WHERE v.deleted_at IS NULL`
+	classTopicGroups = `
+		GROUP BY v.class_id, lower(t.topic)`
+
+	lectureOrder     = `v.sequence, coalesce(v.recorded_at, v.created_at), v.id`
+	lectureOrderDesc = `v.sequence DESC, coalesce(v.recorded_at, v.created_at) DESC, v.id DESC`
+)
+
+// migrateClassTopics adds an index for prefix lookups and builds the topic
+// index for videos uploaded before it existed.  An index built before it
+// tracked first and last lectures is built again.
+func migrateClassTopics(db *gorm.DB) error {
+	err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_class_topics_prefix
+		ON class_topics (class_id, normalized varchar_pattern_ops)`).Error
+	if err != nil {
+		return err
+	}
+	var count int
+	if err := db.Model(&ClassTopic{}).Count(&count).Error; err != nil {
+		return err
+	}
+	var stale int
+	if err := db.Model(&ClassTopic{}).Where("first_video_id IS NULL").Count(&stale).Error; err != nil {
+		return err
+	}
+	if count > 0 && stale == 0 {
+		return nil
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Delete(&ClassTopic{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Exec(classTopicCounts + classTopicGroups).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -1,21 +1,50 @@
 package models
 
 import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/rand"
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 )
 
+// classNameIndex keeps the names of live classes unique whatever their case,
+// so two classes saved at once cannot both take a name.
+const classNameIndex = "idx_classes_live_name"
+
+// Class is a course taught by the professor in OwnerID.  Code is an optional
+// course code such as "CS 61A".  Co-instructors are users enrolled in the
+// class with the professor role.
 type Class struct {
 	gorm.Model
-	Name        string
-	Description string
-	Videos      []Video
+	OwnerID     uint   `gorm:"index"`
+	Name        string `gorm:"size:100;not null"`
+	Code        string `gorm:"size:20"`
+	Description string `gorm:"size:2000"`
+	// EnrollCode is the secret students give to enroll themselves.  It is
+	// only shown to instructors, never in class listings.
+	EnrollCode string `gorm:"size:20" json:"-"`
+	Videos     []Video
 }
 
 type ClassDB interface {
 	GetAll() ([]Class, error)
 	GetClassByID(id uint) (*Class, error)
 	GetClassByName(name string) (*Class, error)
+	// GetDeletedClassByID looks up a class that has been soft deleted.
+	GetDeletedClassByID(id uint) (*Class, error)
+	// CreateClass saves a class and, when it has an owner, enrolls them as
+	// its professor, both or neither.
 	CreateClass(class *Class) error
+	Update(class *Class) error
+	Delete(id uint) error
+	Restore(id uint) error
+	// ResetEnrollCode gives a class a new enrollment code, so the old one no
+	// longer works, and returns it.
+	ResetEnrollCode(id uint) (string, error)
 }
 
 type ClassService interface {
@@ -23,21 +52,250 @@ type ClassService interface {
 }
 
 func NewClassService(db *gorm.DB) ClassService {
+	cg := &classGorm{db}
+	cv := newClassValidator(cg)
 	return &classService{
-		ClassDB: &classGorm{db},
+		ClassDB: cv,
 	}
 }
 
+var _ ClassService = &classService{}
+
 type classService struct {
 	ClassDB
 }
 
+const (
+	// MaxClassNameLength is the longest a class name can be.
+	MaxClassNameLength = 100
+	// MaxClassDescriptionLength is the longest a class description can be.
+	MaxClassDescriptionLength = 2000
+)
+
+// These functions run validation checks on a class before it reaches the
+// database, the same way userValFunc does for users.
+type classValFunc func(*Class) error
+
+func runClassValFuncs(class *Class, fns ...classValFunc) error {
+	for _, fn := range fns {
+		if err := fn(class); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ensures that classValidator implements ClassDB interface
+var _ ClassDB = &classValidator{}
+
+type classValidator struct {
+	ClassDB
+	whitespaceRegex *regexp.Regexp
+	codeRegex       *regexp.Regexp
+}
+
+func newClassValidator(cdb ClassDB) *classValidator {
+	return &classValidator{
+		ClassDB:         cdb,
+		whitespaceRegex: regexp.MustCompile(`\s+`),
+		// Department letters, then a course number with optional letter
+		// prefix and suffix, e.g. "CS 61A", "MATH 1B" or "EE C106A".
+		codeRegex: regexp.MustCompile(`^([A-Z]{2,10}) ?([A-Z]?[0-9]{1,4}[A-Z]{0,3})$`),
+	}
+}
+
+// GetClassByName normalizes the name first, so lookups match the way names
+// are stored.
+func (cv *classValidator) GetClassByName(name string) (*Class, error) {
+	class := Class{
+		Name: name,
+	}
+	if err := runClassValFuncs(&class, cv.normalizeName); err != nil {
+		return nil, err
+	}
+	return cv.ClassDB.GetClassByName(class.Name)
+}
+
+func (cv *classValidator) CreateClass(class *Class) error {
+	err := runClassValFuncs(class,
+		cv.normalizeName,
+		cv.requireName,
+		cv.nameMaxLength,
+		cv.normalizeCode,
+		cv.codeFormat,
+		cv.normalizeDescription,
+		cv.descriptionMaxLength,
+		cv.nameIsAvail,
+		cv.setEnrollCode)
+	if err != nil {
+		return err
+	}
+	return cv.ClassDB.CreateClass(class)
+}
+
+func (cv *classValidator) Update(class *Class) error {
+	err := runClassValFuncs(class,
+		cv.idGreaterThan(0),
+		cv.normalizeName,
+		cv.requireName,
+		cv.nameMaxLength,
+		cv.normalizeCode,
+		cv.codeFormat,
+		cv.normalizeDescription,
+		cv.descriptionMaxLength,
+		cv.nameIsAvail)
+	if err != nil {
+		return err
+	}
+	return cv.ClassDB.Update(class)
+}
+
+func (cv *classValidator) Delete(id uint) error {
+	var class Class
+	class.ID = id
+	if err := runClassValFuncs(&class, cv.idGreaterThan(0)); err != nil {
+		return err
+	}
+	return cv.ClassDB.Delete(id)
+}
+
+// Restore makes sure no live class took the name while this one was deleted.
+func (cv *classValidator) Restore(id uint) error {
+	class, err := cv.GetDeletedClassByID(id)
+	if err != nil {
+		return err
+	}
+	if err := runClassValFuncs(class, cv.nameIsAvail); err != nil {
+		return err
+	}
+	return cv.ClassDB.Restore(id)
+}
+
+func (cv *classValidator) ResetEnrollCode(id uint) (string, error) {
+	var class Class
+	class.ID = id
+	if err := runClassValFuncs(&class, cv.idGreaterThan(0)); err != nil {
+		return "", err
+	}
+	return cv.ClassDB.ResetEnrollCode(id)
+}
+
+func (cv *classValidator) idGreaterThan(n uint) classValFunc {
+	return classValFunc(func(class *Class) error {
+		if class.ID <= n {
+			return ErrIDInvalid
+		}
+		return nil
+	})
+}
+
+// Trims the name and collapses runs of whitespace into single spaces
+func (cv *classValidator) normalizeName(class *Class) error {
+	class.Name = strings.TrimSpace(cv.whitespaceRegex.ReplaceAllString(class.Name, " "))
+	return nil
+}
+
+func (cv *classValidator) requireName(class *Class) error {
+	if class.Name == "" {
+		return ErrClassNameRequired
+	}
+	return nil
+}
+
+func (cv *classValidator) nameMaxLength(class *Class) error {
+	if utf8.RuneCountInString(class.Name) > MaxClassNameLength {
+		return ErrClassNameTooLong
+	}
+	return nil
+}
+
+// Upper cases the course code and puts exactly one space between the
+// department and the number, so "cs61a" and "CS  61A" both become "CS 61A"
+func (cv *classValidator) normalizeCode(class *Class) error {
+	code := strings.ToUpper(class.Code)
+	code = strings.TrimSpace(cv.whitespaceRegex.ReplaceAllString(code, " "))
+	if m := cv.codeRegex.FindStringSubmatch(code); m != nil {
+		code = m[1] + " " + m[2]
+	}
+	class.Code = code
+	return nil
+}
+
+func (cv *classValidator) codeFormat(class *Class) error {
+	if class.Code == "" {
+		return nil
+	}
+	if !cv.codeRegex.MatchString(class.Code) {
+		return ErrClassCodeInvalid
+	}
+	return nil
+}
+
+// Descriptions keep their line breaks, only the ends are trimmed
+func (cv *classValidator) normalizeDescription(class *Class) error {
+	class.Description = strings.TrimSpace(class.Description)
+	return nil
+}
+
+func (cv *classValidator) descriptionMaxLength(class *Class) error {
+	if utf8.RuneCountInString(class.Description) > MaxClassDescriptionLength {
+		return ErrClassDescriptionTooLong
+	}
+	return nil
+}
+
+func (cv *classValidator) setEnrollCode(class *Class) error {
+	if class.EnrollCode != "" {
+		return nil
+	}
+	code, err := newEnrollCode()
+	if err != nil {
+		return err
+	}
+	class.EnrollCode = code
+	return nil
+}
+
+// Upload looks classes up by name, so no two live classes may share one.
+func (cv *classValidator) nameIsAvail(class *Class) error {
+	existing, err := cv.ClassDB.GetClassByName(class.Name)
+	if err == ErrClassNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.ID != class.ID {
+		return ErrClassNameTaken
+	}
+	return nil
+}
+
+var _ ClassDB = &classGorm{}
+
 type classGorm struct {
 	db *gorm.DB
 }
 
 func (cg *classGorm) CreateClass(class *Class) error {
-	return cg.db.Create(class).Error
+	tx := cg.db.Begin()
+	if err := tx.Create(class).Error; err != nil {
+		tx.Rollback()
+		return classNameError(err)
+	}
+	if class.OwnerID != 0 {
+		enrollment := Enrollment{
+			UserID:     class.OwnerID,
+			ClassID:    class.ID,
+			Role:       EnrollmentProfessor,
+			EnrolledAt: time.Now(),
+		}
+		if err := tx.Create(&enrollment).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
 }
 
 func (cg *classGorm) GetAll() ([]Class, error) {
@@ -50,7 +308,10 @@ func (cg *classGorm) GetAll() ([]Class, error) {
 
 func (cg *classGorm) GetClassByID(id uint) (*Class, error) {
 	class := Class{}
-	err := cg.db.Where("id = ?", id).First(&class).Error
+	err := first(cg.db.Where("id = ?", id), &class)
+	if err == ErrResourceNotFound {
+		return nil, ErrClassNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -59,9 +320,81 @@ func (cg *classGorm) GetClassByID(id uint) (*Class, error) {
 
 func (cg *classGorm) GetClassByName(name string) (*Class, error) {
 	class := Class{}
-	err := cg.db.Where("name = ?", name).First(&class).Error
+	err := first(cg.db.Where("lower(name) = lower(?)", name), &class)
+	if err == ErrResourceNotFound {
+		return nil, ErrClassNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &class, nil
 }
+
+func (cg *classGorm) GetDeletedClassByID(id uint) (*Class, error) {
+	class := Class{}
+	db := cg.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	err := first(db, &class)
+	if err == ErrResourceNotFound {
+		return nil, ErrClassNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &class, nil
+}
+
+func (cg *classGorm) Update(class *Class) error {
+	return classNameError(cg.db.Save(class).Error)
+}
+
+// Delete soft deletes the class by setting deleted_at.  Its videos and
+// enrollments are kept so the class can be restored.
+func (cg *classGorm) Delete(id uint) error {
+	class := Class{}
+	class.ID = id
+	return cg.db.Delete(&class).Error
+}
+
+func (cg *classGorm) Restore(id uint) error {
+	err := cg.db.Unscoped().Model(&Class{}).
+		Where("id = ?", id).
+		UpdateColumn("deleted_at", nil).Error
+	return classNameError(err)
+}
+
+func (cg *classGorm) ResetEnrollCode(id uint) (string, error) {
+	code, err := newEnrollCode()
+	if err != nil {
+		return "", err
+	}
+	db := cg.db.Model(&Class{}).Where("id = ?", id).UpdateColumn("enroll_code", code)
+	if db.Error != nil {
+		return "", db.Error
+	}
+	if db.RowsAffected == 0 {
+		return "", ErrClassNotFound
+	}
+	return code, nil
+}
+
+// newEnrollCode makes a code short enough to read out in a lecture, but too
+// long to guess.
+func newEnrollCode() (string, error) {
+	return rand.String(9)
+}
+
+// classNameError turns a clash on classNameIndex into ErrClassNameTaken, for
+// when another class took the name after nameIsAvail looked.
+func classNameError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && pqErr.Constraint == classNameIndex {
+		return ErrClassNameTaken
+	}
+	return err
+}
+
+// migrateClasses adds classNameIndex.  Live classes that already share a
+// name must be renamed first.
+func migrateClasses(db *gorm.DB) error {
+	return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS ` + classNameIndex + `
+		ON classes (lower(name)) WHERE deleted_at IS NULL`).Error
+}
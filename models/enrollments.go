@@ -0,0 +1,225 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Roles a user can have within a single class, stored in Enrollment.Role.
+const (
+	EnrollmentStudent   = "student"
+	EnrollmentTA        = "ta"
+	EnrollmentProfessor = "professor"
+)
+
+// Enrollment records that a user belongs to a class.  Dropping a class
+// deletes the row outright so the user can enroll again later.
+type Enrollment struct {
+	ID         uint      `gorm:"primary_key"`
+	UserID     uint      `gorm:"not null;unique_index:idx_enrollments_user_class"`
+	ClassID    uint      `gorm:"not null;unique_index:idx_enrollments_user_class;index"`
+	Role       string    `gorm:"not null"`
+	EnrolledAt time.Time `gorm:"not null"`
+}
+
+type EnrollmentDB interface {
+	ByUserAndClass(userID, classID uint) (*Enrollment, error)
+	ByUser(userID uint) ([]Enrollment, error)
+	ByClass(classID uint) ([]Enrollment, error)
+	ClassesByUser(userID uint) ([]Class, error)
+
+	Create(enrollment *Enrollment) error
+	// UpdateRole changes the role of an existing enrollment.
+	UpdateRole(enrollment *Enrollment) error
+	Delete(userID, classID uint) error
+}
+
+type EnrollmentService interface {
+	EnrollmentDB
+}
+
+func NewEnrollmentService(db *gorm.DB) EnrollmentService {
+	eg := &enrollmentGorm{db}
+	return &enrollmentService{
+		EnrollmentDB: newEnrollmentValidator(eg),
+	}
+}
+
+var _ EnrollmentService = &enrollmentService{}
+
+type enrollmentService struct {
+	EnrollmentDB
+}
+
+type enrollmentValFunc func(*Enrollment) error
+
+func runEnrollmentValFuncs(enrollment *Enrollment, fns ...enrollmentValFunc) error {
+	for _, fn := range fns {
+		if err := fn(enrollment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ EnrollmentDB = &enrollmentValidator{}
+
+type enrollmentValidator struct {
+	EnrollmentDB
+}
+
+func newEnrollmentValidator(edb EnrollmentDB) *enrollmentValidator {
+	return &enrollmentValidator{
+		EnrollmentDB: edb,
+	}
+}
+
+func (ev *enrollmentValidator) Create(enrollment *Enrollment) error {
+	err := runEnrollmentValFuncs(enrollment,
+		ev.requireUserID,
+		ev.requireClassID,
+		ev.defaultRole,
+		ev.roleValid,
+		ev.notEnrolled,
+		ev.setEnrolledAt)
+	if err != nil {
+		return err
+	}
+	return ev.EnrollmentDB.Create(enrollment)
+}
+
+func (ev *enrollmentValidator) UpdateRole(enrollment *Enrollment) error {
+	err := runEnrollmentValFuncs(enrollment,
+		ev.requireUserID,
+		ev.requireClassID,
+		ev.roleValid)
+	if err != nil {
+		return err
+	}
+	return ev.EnrollmentDB.UpdateRole(enrollment)
+}
+
+func (ev *enrollmentValidator) requireUserID(enrollment *Enrollment) error {
+	if enrollment.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (ev *enrollmentValidator) requireClassID(enrollment *Enrollment) error {
+	if enrollment.ClassID == 0 {
+		return ErrClassIDRequired
+	}
+	return nil
+}
+
+func (ev *enrollmentValidator) defaultRole(enrollment *Enrollment) error {
+	if enrollment.Role == "" {
+		enrollment.Role = EnrollmentStudent
+	}
+	return nil
+}
+
+func (ev *enrollmentValidator) roleValid(enrollment *Enrollment) error {
+	switch enrollment.Role {
+	case EnrollmentStudent, EnrollmentTA, EnrollmentProfessor:
+		return nil
+	}
+	return ErrEnrollmentRoleInvalid
+}
+
+func (ev *enrollmentValidator) notEnrolled(enrollment *Enrollment) error {
+	_, err := ev.ByUserAndClass(enrollment.UserID, enrollment.ClassID)
+	switch err {
+	case ErrNotEnrolled:
+		return nil
+	case nil:
+		return ErrAlreadyEnrolled
+	default:
+		return err
+	}
+}
+
+func (ev *enrollmentValidator) setEnrolledAt(enrollment *Enrollment) error {
+	if enrollment.EnrolledAt.IsZero() {
+		enrollment.EnrolledAt = time.Now()
+	}
+	return nil
+}
+
+var _ EnrollmentDB = &enrollmentGorm{}
+
+type enrollmentGorm struct {
+	db *gorm.DB
+}
+
+func (eg *enrollmentGorm) ByUserAndClass(userID, classID uint) (*Enrollment, error) {
+	var enrollment Enrollment
+	db := eg.db.Where("user_id = ? AND class_id = ?", userID, classID)
+	err := first(db, &enrollment)
+	if err == ErrResourceNotFound {
+		return nil, ErrNotEnrolled
+	}
+	return &enrollment, err
+}
+
+func (eg *enrollmentGorm) ByUser(userID uint) ([]Enrollment, error) {
+	enrollments := []Enrollment{}
+	err := eg.db.Where("user_id = ?", userID).Order("enrolled_at").Find(&enrollments).Error
+	if err != nil {
+		return nil, err
+	}
+	return enrollments, nil
+}
+
+func (eg *enrollmentGorm) ByClass(classID uint) ([]Enrollment, error) {
+	enrollments := []Enrollment{}
+	err := eg.db.Where("class_id = ?", classID).Order("enrolled_at").Find(&enrollments).Error
+	if err != nil {
+		return nil, err
+	}
+	return enrollments, nil
+}
+
+// ClassesByUser returns every class the user is enrolled in, whatever their
+// role.
+func (eg *enrollmentGorm) ClassesByUser(userID uint) ([]Class, error) {
+	classes := []Class{}
+	err := eg.db.Joins("JOIN enrollments ON enrollments.class_id = classes.id").
+		Where("enrollments.user_id = ?", userID).
+		Order("enrollments.enrolled_at").
+		Find(&classes).Error
+	if err != nil {
+		return nil, err
+	}
+	return classes, nil
+}
+
+func (eg *enrollmentGorm) Create(enrollment *Enrollment) error {
+	return eg.db.Create(enrollment).Error
+}
+
+func (eg *enrollmentGorm) UpdateRole(enrollment *Enrollment) error {
+	db := eg.db.Model(&Enrollment{}).
+		Where("user_id = ? AND class_id = ?", enrollment.UserID, enrollment.ClassID).
+		UpdateColumn("role", enrollment.Role)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotEnrolled
+	}
+	return nil
+}
+
+func (eg *enrollmentGorm) Delete(userID, classID uint) error {
+	db := eg.db.Where("user_id = ? AND class_id = ?", userID, classID).Delete(&Enrollment{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotEnrolled
+	}
+	return nil
+}
@@ -24,6 +24,197 @@ const (
 	// ErrPasswordTooShort is returned when an update or create is
 	// attempted with a user password that is less than 8 characters.
 	ErrPasswordTooShort modelError = "models: password must be at least 8 characters long"
+	// ErrUserTypeInvalid is returned when a user is created or updated with a
+	// user type that is not one of the known roles.
+	ErrUserTypeInvalid modelError = "models: user type must be one of student, professor, ta or admin"
+	// ErrRefreshTokenRequired is returned when a refresh is attempted
+	// without a refresh token.
+	ErrRefreshTokenRequired modelError = "models: refresh token is required"
+	// ErrRefreshTokenInvalid is returned when a refresh token does not exist
+	// or has already been used or revoked.
+	ErrRefreshTokenInvalid modelError = "models: refresh token is invalid"
+	// ErrRefreshTokenExpired is returned when a refresh token is used after
+	// it has expired.
+	ErrRefreshTokenExpired modelError = "models: refresh token has expired"
+	// ErrResetTokenInvalid is returned when a password reset token is
+	// malformed, forged or has already been used.
+	ErrResetTokenInvalid modelError = "models: password reset token is invalid"
+	// ErrResetTokenExpired is returned when a password reset token is used
+	// after it has expired.
+	ErrResetTokenExpired modelError = "models: password reset token has expired"
+	// ErrClassNotFound is returned when a class cannot be found in the
+	// database.
+	ErrClassNotFound modelError = "models: class not found"
+	// ErrClassNameRequired is returned when a class is saved without a name.
+	ErrClassNameRequired modelError = "models: class name is required"
+	// ErrClassNameTaken is returned when a class is saved with the name of
+	// another class.  Uploads find classes by name, so names must be unique.
+	ErrClassNameTaken modelError = "models: class name is already taken"
+	// ErrClassNameTooLong is returned when a class name is longer than
+	// MaxClassNameLength.
+	ErrClassNameTooLong modelError = "models: class name must be at most 100 characters long"
+	// ErrClassDescriptionTooLong is returned when a class description is
+	// longer than MaxClassDescriptionLength.
+	ErrClassDescriptionTooLong modelError = "models: class description must be at most 2000 characters long"
+	// ErrClassCodeInvalid is returned when a course code does not look like
+	// "CS 61A".
+	ErrClassCodeInvalid modelError = "models: course code must look like CS 61A"
+	// ErrClassIDRequired is returned when something that belongs to a class
+	// is created without a class ID.
+	ErrClassIDRequired modelError = "models: class ID is required"
+	// ErrNotEnrolled is returned when looking up or dropping an enrollment
+	// that does not exist.
+	ErrNotEnrolled modelError = "models: not enrolled in this class"
+	// ErrEnrollCodeInvalid is returned when a user tries to enroll in a class
+	// without its current enrollment code.
+	ErrEnrollCodeInvalid modelError = "models: enrollment code is not valid for this class"
+	// ErrAlreadyEnrolled is returned when a user enrolls in a class twice.
+	ErrAlreadyEnrolled modelError = "models: already enrolled in this class"
+	// ErrEnrollmentRoleInvalid is returned when an enrollment has a role
+	// other than student, ta or professor.
+	ErrEnrollmentRoleInvalid modelError = "models: class role must be one of student, ta or professor"
+	// ErrVideoNotFound is returned when a video cannot be found in the
+	// database.
+	ErrVideoNotFound modelError = "models: video not found"
+	// ErrVideoURLRequired is returned when a video is saved without a URL.
+	ErrVideoURLRequired modelError = "models: video URL is required"
+	// ErrVideoURLInvalid is returned when a video URL is not a gs://, s3://,
+	// http:// or https:// URL.
+	ErrVideoURLInvalid modelError = "models: video URL must be a gs, s3, http or https URL"
+	// ErrTopicTooLong is returned when a topic is longer than MaxTopicLength.
+	ErrTopicTooLong modelError = "models: topics must be at most 200 characters long"
+	// ErrResourceTooLong is returned when a related resource is longer than
+	// MaxTopicLength.
+	ErrResourceTooLong modelError = "models: related resources must be at most 200 characters long"
+	// ErrVideoTitleTooLong is returned when a lecture title is longer than
+	// MaxVideoTitleLength.
+	ErrVideoTitleTooLong modelError = "models: lecture title must be at most 200 characters long"
+	// ErrVideoDescriptionTooLong is returned when a lecture description is
+	// longer than MaxVideoDescriptionLength.
+	ErrVideoDescriptionTooLong modelError = "models: lecture description must be at most 2000 characters long"
+	// ErrVideoSequenceInvalid is returned when a lecture number is negative.
+	ErrVideoSequenceInvalid modelError = "models: lecture number cannot be negative"
+	// ErrVideoDurationInvalid is returned when a lecture duration is negative.
+	ErrVideoDurationInvalid modelError = "models: lecture duration cannot be negative"
+	// ErrThumbnailURLInvalid is returned when a thumbnail URL is not a gs://,
+	// s3://, http:// or https:// URL.
+	ErrThumbnailURLInvalid modelError = "models: thumbnail URL must be a gs, s3, http or https URL"
+	// ErrVideoOrderInvalid is returned when videos are listed in an order
+	// that does not exist.
+	ErrVideoOrderInvalid modelError = "models: videos can only be ordered by sequence, recorded or created"
+	// ErrTranscriptTextRequired is returned when a transcript segment has no
+	// text.
+	ErrTranscriptTextRequired modelError = "models: transcript segments must have text"
+	// ErrTranscriptTimesInvalid is returned when a transcript segment starts
+	// before zero or ends before it starts.
+	ErrTranscriptTimesInvalid modelError = "models: transcript segments must not end before they start"
+	// ErrTranscriptConfidenceInvalid is returned when a transcript segment's
+	// confidence is not between 0 and 1.
+	ErrTranscriptConfidenceInvalid modelError = "models: transcript confidence must be between 0 and 1"
+	// ErrTranscriptWindowInvalid is returned when a transcript is requested
+	// for a time window that ends before it starts.
+	ErrTranscriptWindowInvalid modelError = "models: transcript time window must end after it starts"
+	// ErrTopicRequired is returned when a topic timestamp has no topic.
+	ErrTopicRequired modelError = "models: topic is required"
+	// ErrTopicTimesInvalid is returned when a topic timestamp starts before
+	// zero or ends before it starts.
+	ErrTopicTimesInvalid modelError = "models: topic timestamps must not end before they start"
+	// ErrSearchQueryRequired is returned when a search is run without
+	// a query.
+	ErrSearchQueryRequired modelError = "models: search query is required"
+	// ErrSearchQueryTooLong is returned when a search query is longer than
+	// MaxSearchQueryLength characters.
+	ErrSearchQueryTooLong modelError = "models: search query must be at most 200 characters"
+	// ErrSearchDatesInvalid is returned when a search's date range ends
+	// before it starts.
+	ErrSearchDatesInvalid modelError = "models: search date range must end after it starts"
+	// ErrKeywordRequired is returned when a keyword search is run without
+	// any keywords.
+	ErrKeywordRequired modelError = "models: at least one keyword is required"
+	// ErrKeywordModeInvalid is returned when keywords are combined with
+	// anything but any or all.
+	ErrKeywordModeInvalid modelError = "models: keyword mode must be any or all"
+	// ErrTopicOrderInvalid is returned when a topic map is asked for in an
+	// order other than frequency or chronology.
+	ErrTopicOrderInvalid modelError = "models: topic order must be frequency or chronology"
+	// ErrRelatedResourceNotFound is returned when a related resource does
+	// not exist or was deleted.
+	ErrRelatedResourceNotFound modelError = "models: related resource not found"
+	// ErrResourceRequired is returned when a related resource has neither a
+	// URL nor a title.
+	ErrResourceRequired modelError = "models: related resources need a URL or a title"
+	// ErrResourceURLInvalid is returned when a related resource's URL is not
+	// an http or https link.
+	ErrResourceURLInvalid modelError = "models: related resource URL must be an http or https link"
+	// ErrResourceTitleTooLong is returned when a related resource's title is
+	// longer than MaxResourceTitleLength.
+	ErrResourceTitleTooLong modelError = "models: related resource title must be at most 200 characters long"
+	// ErrResourceKindInvalid is returned when a related resource's kind is
+	// not one of the known kinds.
+	ErrResourceKindInvalid modelError = "models: related resource kind must be one of article, video, pdf, worksheet or other"
+	// ErrResourceOriginInvalid is returned when a related resource's origin
+	// is not pipeline, professor or student.
+	ErrResourceOriginInvalid modelError = "models: related resource origin must be pipeline, professor or student"
+	// ErrResourceTimestampInvalid is returned when a related resource is tied
+	// to a moment before the start of the lecture.
+	ErrResourceTimestampInvalid modelError = "models: related resource timestamp must not be negative"
+	// ErrVideoObjectKeyInvalid is returned when a video's object key is
+	// absolute, climbs out of the store with "..", or is outside its class's
+	// storage.ClassPrefix.
+	ErrVideoObjectKeyInvalid modelError = "models: video object key must be in its class's storage"
+	// ErrUploadNotFound is returned when an upload cannot be found in the
+	// database.
+	ErrUploadNotFound modelError = "models: upload not found"
+	// ErrUploadFilenameInvalid is returned when an upload has no file name or
+	// one longer than MaxUploadFilenameLength.
+	ErrUploadFilenameInvalid modelError = "models: upload file name must be between 1 and 200 characters long"
+	// ErrUploadEmpty is returned when an upload has no bytes.
+	ErrUploadEmpty modelError = "models: uploaded file is empty"
+	// ErrUploadTooLarge is returned when an upload is larger than the
+	// configured limit.
+	ErrUploadTooLarge modelError = "models: uploaded file is too large"
+	// ErrUploadTypeInvalid is returned when an upload is not one of the
+	// configured kinds of recording.
+	ErrUploadTypeInvalid modelError = "models: uploaded file must be a supported audio or video type"
+	// ErrUploadChecksumInvalid is returned when an upload's checksum is not a
+	// hex encoded SHA-256 digest.
+	ErrUploadChecksumInvalid modelError = "models: upload checksum must be a hex encoded SHA-256 digest"
+	// ErrUploadChecksumMismatch is returned when an uploaded file does not
+	// have the checksum it was sent with.
+	ErrUploadChecksumMismatch modelError = "models: uploaded file does not match its checksum"
+	// ErrUploadOffsetInvalid is returned when an upload's offset is negative
+	// or past its end.
+	ErrUploadOffsetInvalid modelError = "models: upload offset is out of range"
+	// ErrUploadBusy is returned when a chunk arrives for an upload that is
+	// still taking another one.
+	ErrUploadBusy modelError = "models: upload is still receiving another chunk"
+	// ErrVideoStatusInvalid is returned when a video's status is not pending
+	// or ready.
+	ErrVideoStatusInvalid modelError = "models: video status must be pending or ready"
+	// ErrRenditionNotFound is returned when a rendition cannot be found in the
+	// database.
+	ErrRenditionNotFound modelError = "models: rendition not found"
+	// ErrRenditionNameInvalid is returned when a rendition has no name or one
+	// longer than MaxRenditionNameLength.
+	ErrRenditionNameInvalid modelError = "models: rendition name must be between 1 and 50 characters long"
+	// ErrRenditionBandwidthInvalid is returned when a rendition's bandwidth is
+	// not positive or its average is above its peak.
+	ErrRenditionBandwidthInvalid modelError = "models: rendition bandwidth must be positive and at least its average"
+	// ErrRenditionDimensionsInvalid is returned when a rendition's size or
+	// frame rate is negative.
+	ErrRenditionDimensionsInvalid modelError = "models: rendition size and frame rate must not be negative"
+	// ErrRenditionCodecsInvalid is returned when a rendition's codecs list is
+	// too long or has quotes or line breaks.
+	ErrRenditionCodecsInvalid modelError = "models: rendition codecs are invalid"
+	// ErrRenditionSegmentsRequired is returned when a rendition is saved
+	// without segments.
+	ErrRenditionSegmentsRequired modelError = "models: rendition must have at least one segment"
+	// ErrRenditionSegmentInvalid is returned when a segment has no length or
+	// an invalid object key.
+	ErrRenditionSegmentInvalid modelError = "models: rendition segments need a positive duration and a valid object key"
+	// ErrRenditionSegmentKeyInvalid is returned when a segment's object key
+	// is outside the storage.ClassPrefix of its video's class.
+	ErrRenditionSegmentKeyInvalid modelError = "models: rendition segments must be in their class's storage"
 	// ErrVehicleRegNumNotFound is returned when looking for a vehicle
 	// registration number that does not exist
 	ErrVehicleRegNumNotFound modelError = `models: vehicle registration number not found.
@@ -0,0 +1,204 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultSimilarity is the trigram similarity a topic needs to match a
+	// keyword when none is configured, the same default pg_trgm uses.
+	DefaultSimilarity = 0.3
+	// DefaultSimilarTopics is how many suggestions SimilarTopics returns
+	// when no limit is asked for.
+	DefaultSimilarTopics = 5
+	// MaxSimilarTopics is the most suggestions SimilarTopics returns.
+	MaxSimilarTopics = 20
+)
+
+// KeywordMatch is a video found by GetByKeywords.  MatchedKeywords are the
+// keywords it matched, spelled as they were given, and MatchedTopics are the
+// topics of the video they matched, which differ when a keyword was
+// misspelled or only part of a topic.
+type KeywordMatch struct {
+	Video           Video
+	MatchedKeywords []string
+	MatchedTopics   []string
+}
+
+// TopicMatch is a known topic suggested for a search term.  Similarity is
+// the trigram similarity of the term to the topic, from 0 to 1, and Distance
+// is the number of single letter edits between them.
+type TopicMatch struct {
+	Topic      string
+	Similarity float64
+	Distance   int
+}
+
+type keywordHit struct {
+	VideoID uint
+	Keyword string
+	Topic   string
+}
+
+// GetByKeywords finds every (video, keyword, topic) triple where the topic
+// matches the keyword, then works out which videos matched enough keywords.
+// word_similarity scores how well the keyword matches any part of the topic,
+// so "djikstra" finds "Dijkstra's algorithm" and "dyn prog" finds "dynamic
+// programming".
+func (vg *videoGorm) GetByKeywords(classID uint, keywords []string, mode string) ([]KeywordMatch, error) {
+	hits := []keywordHit{}
+	err := vg.db.Raw(`
+		SELECT v.id AS video_id, k.keyword, t.topic
+		FROM videos v, unnest(v.topics) AS t(topic), unnest(ARRAY[?]::text[]) AS k(keyword)
+		WHERE v.deleted_at IS NULL AND v.class_id = ?
+			AND (lower(t.topic) = lower(k.keyword)
+				OR word_similarity(lower(k.keyword), lower(t.topic)) >= ?)`,
+		keywords, classID, vg.similarity).
+		Scan(&hits).Error
+	if err != nil {
+		return nil, err
+	}
+
+	matched := map[uint]map[string]bool{}
+	topics := map[uint][]string{}
+	for _, hit := range hits {
+		if matched[hit.VideoID] == nil {
+			matched[hit.VideoID] = map[string]bool{}
+		}
+		matched[hit.VideoID][hit.Keyword] = true
+		topics[hit.VideoID] = append(topics[hit.VideoID], hit.Topic)
+	}
+	need := 1
+	if mode == KeywordMatchAll {
+		need = len(keywords)
+	}
+	ids := []uint{}
+	for id, kws := range matched {
+		if len(kws) >= need {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return []KeywordMatch{}, nil
+	}
+
+	videos := []Video{}
+	err = vg.db.Where("id IN (?)", ids).
+		Order("sequence").Order("id").
+		Find(&videos).Error
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]KeywordMatch, len(videos))
+	for i, video := range videos {
+		match := KeywordMatch{
+			Video:           video,
+			MatchedKeywords: []string{},
+			MatchedTopics:   dedupeStrings(topics[video.ID]),
+		}
+		for _, keyword := range keywords {
+			if matched[video.ID][keyword] {
+				match.MatchedKeywords = append(match.MatchedKeywords, keyword)
+			}
+		}
+		matches[i] = match
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return len(matches[i].MatchedKeywords) > len(matches[j].MatchedKeywords)
+	})
+	return matches, nil
+}
+
+// SimilarTopics lets pg_trgm find the candidate topics, then ranks them by
+// edit distance so the likeliest correction of a typo comes first.
+func (vg *videoGorm) SimilarTopics(classID uint, term string, limit int) ([]TopicMatch, error) {
+	candidates := []TopicMatch{}
+	err := vg.db.Raw(`
+		SELECT topic, max(similarity) AS similarity
+		FROM (
+			SELECT t.topic, word_similarity(lower(?), lower(t.topic)) AS similarity
+			FROM videos v, unnest(v.topics) AS t(topic)
+			WHERE v.deleted_at IS NULL AND v.class_id = ?
+		) c
+		WHERE similarity >= ?
+		GROUP BY topic`,
+		term, classID, vg.similarity).
+		Scan(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Topics differing only by case across lectures are one suggestion
+	best := map[string]TopicMatch{}
+	for _, c := range candidates {
+		key := strings.ToLower(c.Topic)
+		if b, ok := best[key]; ok && b.Similarity >= c.Similarity {
+			continue
+		}
+		c.Distance = levenshtein(strings.ToLower(term), key)
+		best[key] = c
+	}
+	matches := make([]TopicMatch, 0, len(best))
+	for _, m := range best {
+		matches = append(matches, m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		if matches[i].Similarity != matches[j].Similarity {
+			return matches[i].Similarity > matches[j].Similarity
+		}
+		return matches[i].Topic < matches[j].Topic
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// levenshtein counts the single letter insertions, deletions and
+// substitutions needed to turn a into b.
+func levenshtein(a, b string) int {
+	if a == b {
+		return 0
+	}
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 {
+		return utf8.RuneCountInString(b)
+	}
+	if len(rb) == 0 {
+		return utf8.RuneCountInString(a)
+	}
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
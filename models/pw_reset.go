@@ -0,0 +1,72 @@
+package models
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/hash"
+	"github.com/TerrenceHo/CalHacks4-Backend/rand"
+)
+
+// ResetTokenDuration is how long a password reset token stays valid.
+const ResetTokenDuration = time.Hour
+
+// A reset token is "<payload>.<mac>", both base64 URL encoded.  The payload
+// is "<user id>:<expiry unix>:<nonce>", and the mac is an HMAC of the payload
+// and the user's current password hash.  Once the password changes the hash
+// changes with it, so a token can only ever be used once.
+
+// newResetToken mints a reset token for user that expires at expiresAt.
+func newResetToken(secret hash.HMAC, user *User, expiresAt time.Time) (string, error) {
+	nonce, err := rand.String(16)
+	if err != nil {
+		return "", err
+	}
+	payload := fmt.Sprintf("%d:%d:%s", user.ID, expiresAt.Unix(), nonce)
+	mac := secret.Sum([]byte(payload + "|" + user.PasswordHash))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// parseResetToken returns the user ID and expiry in token without checking
+// the mac.  Use verifyResetToken once the user has been loaded.
+func parseResetToken(token string) (uint, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return 0, time.Time{}, ErrResetTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, time.Time{}, ErrResetTokenInvalid
+	}
+	var id uint
+	var expires int64
+	var nonce string
+	if _, err := fmt.Sscanf(string(payload), "%d:%d:%s", &id, &expires, &nonce); err != nil {
+		return 0, time.Time{}, ErrResetTokenInvalid
+	}
+	return id, time.Unix(expires, 0), nil
+}
+
+// verifyResetToken checks the mac in token against user.
+func verifyResetToken(secret hash.HMAC, user *User, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return ErrResetTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrResetTokenInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrResetTokenInvalid
+	}
+	expected := secret.Sum([]byte(string(payload) + "|" + user.PasswordHash))
+	if !hash.Equal(mac, expected) {
+		return ErrResetTokenInvalid
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package models
+
+import (
+	"time"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/hash"
+	"github.com/TerrenceHo/CalHacks4-Backend/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// RefreshTokenDuration is how long a refresh token can be used before the
+// user has to log in again.
+const RefreshTokenDuration = 30 * 24 * time.Hour
+
+// RefreshToken is a long lived token that can be traded for a new access
+// token.  Every login starts a session, and each refresh rotates the token
+// while keeping the same SessionID, so revoking a session kills every token
+// that was issued for it.
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	SessionID string `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+type RefreshTokenDB interface {
+	ByToken(token string) (*RefreshToken, error)
+	SessionActive(sessionID string) (bool, error)
+
+	Create(rt *RefreshToken) error
+	Revoke(id uint) error
+	RevokeSession(sessionID string) error
+	RevokeUser(userID uint) error
+}
+
+type RefreshTokenService interface {
+	// Issue starts a new session for the user and returns its first refresh
+	// token.
+	Issue(userID uint) (*RefreshToken, error)
+	// Rotate trades a refresh token for a new one in the same session.
+	Rotate(token string) (*RefreshToken, error)
+	RefreshTokenDB
+}
+
+func NewRefreshTokenService(db *gorm.DB, hmacKey string) RefreshTokenService {
+	rg := &refreshTokenGorm{db}
+	hmac := hash.NewHMAC(hmacKey)
+	return &refreshTokenService{
+		RefreshTokenDB: newRefreshTokenValidator(rg, hmac),
+	}
+}
+
+var _ RefreshTokenService = &refreshTokenService{}
+
+type refreshTokenService struct {
+	RefreshTokenDB
+}
+
+func (rs *refreshTokenService) Issue(userID uint) (*RefreshToken, error) {
+	sessionID, err := rand.Token()
+	if err != nil {
+		return nil, err
+	}
+	rt := RefreshToken{
+		UserID:    userID,
+		SessionID: sessionID,
+	}
+	if err := rs.Create(&rt); err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+func (rs *refreshTokenService) Rotate(token string) (*RefreshToken, error) {
+	old, err := rs.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if old.RevokedAt != nil {
+		// A rotated token being used again means somebody else has a copy of
+		// it, so end the whole session.
+		if err := rs.RevokeSession(old.SessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenInvalid
+	}
+	if time.Now().After(old.ExpiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+	if err := rs.Revoke(old.ID); err != nil {
+		return nil, err
+	}
+
+	rt := RefreshToken{
+		UserID:    old.UserID,
+		SessionID: old.SessionID,
+	}
+	if err := rs.Create(&rt); err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+type refreshTokenValFunc func(*RefreshToken) error
+
+func runRefreshTokenValFuncs(rt *RefreshToken, fns ...refreshTokenValFunc) error {
+	for _, fn := range fns {
+		if err := fn(rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ RefreshTokenDB = &refreshTokenValidator{}
+
+// refreshTokenValidator makes sure only the HMAC of a refresh token ever
+// reaches the database.
+type refreshTokenValidator struct {
+	RefreshTokenDB
+	hmac hash.HMAC
+}
+
+func newRefreshTokenValidator(rdb RefreshTokenDB, hmac hash.HMAC) *refreshTokenValidator {
+	return &refreshTokenValidator{
+		RefreshTokenDB: rdb,
+		hmac:           hmac,
+	}
+}
+
+func (rv *refreshTokenValidator) ByToken(token string) (*RefreshToken, error) {
+	rt := RefreshToken{
+		Token: token,
+	}
+	if err := runRefreshTokenValFuncs(&rt, rv.requireToken, rv.hmacToken); err != nil {
+		return nil, err
+	}
+	return rv.RefreshTokenDB.ByToken(rt.TokenHash)
+}
+
+func (rv *refreshTokenValidator) Create(rt *RefreshToken) error {
+	err := runRefreshTokenValFuncs(rt,
+		rv.requireUserID,
+		rv.requireSessionID,
+		rv.setTokenIfUnset,
+		rv.hmacToken,
+		rv.setExpiryIfUnset)
+	if err != nil {
+		return err
+	}
+	return rv.RefreshTokenDB.Create(rt)
+}
+
+func (rv *refreshTokenValidator) RevokeSession(sessionID string) error {
+	if sessionID == "" {
+		return ErrRefreshTokenInvalid
+	}
+	return rv.RefreshTokenDB.RevokeSession(sessionID)
+}
+
+func (rv *refreshTokenValidator) RevokeUser(userID uint) error {
+	if userID == 0 {
+		return ErrUserIDRequired
+	}
+	return rv.RefreshTokenDB.RevokeUser(userID)
+}
+
+func (rv *refreshTokenValidator) requireToken(rt *RefreshToken) error {
+	if rt.Token == "" {
+		return ErrRefreshTokenRequired
+	}
+	return nil
+}
+
+func (rv *refreshTokenValidator) requireUserID(rt *RefreshToken) error {
+	if rt.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (rv *refreshTokenValidator) requireSessionID(rt *RefreshToken) error {
+	if rt.SessionID == "" {
+		return ErrRefreshTokenInvalid
+	}
+	return nil
+}
+
+func (rv *refreshTokenValidator) setTokenIfUnset(rt *RefreshToken) error {
+	if rt.Token != "" {
+		return nil
+	}
+	token, err := rand.Token()
+	if err != nil {
+		return err
+	}
+	rt.Token = token
+	return nil
+}
+
+// hmacToken hashes the token if it is set, so lookups and inserts only ever
+// see the hash.
+func (rv *refreshTokenValidator) hmacToken(rt *RefreshToken) error {
+	if rt.Token == "" {
+		return nil
+	}
+	rt.TokenHash = rv.hmac.Hash(rt.Token)
+	return nil
+}
+
+func (rv *refreshTokenValidator) setExpiryIfUnset(rt *RefreshToken) error {
+	if rt.ExpiresAt.IsZero() {
+		rt.ExpiresAt = time.Now().Add(RefreshTokenDuration)
+	}
+	return nil
+}
+
+var _ RefreshTokenDB = &refreshTokenGorm{}
+
+type refreshTokenGorm struct {
+	db *gorm.DB
+}
+
+// ByToken looks up a refresh token by its hash.
+func (rg *refreshTokenGorm) ByToken(tokenHash string) (*RefreshToken, error) {
+	var rt RefreshToken
+	db := rg.db.Where("token_hash = ?", tokenHash)
+	err := first(db, &rt)
+	if err == ErrResourceNotFound {
+		return nil, ErrRefreshTokenInvalid
+	}
+	return &rt, err
+}
+
+// SessionActive reports whether the session still has an unrevoked, unexpired
+// refresh token.
+func (rg *refreshTokenGorm) SessionActive(sessionID string) (bool, error) {
+	var count int
+	err := rg.db.Model(&RefreshToken{}).
+		Where("session_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, time.Now()).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (rg *refreshTokenGorm) Create(rt *RefreshToken) error {
+	return rg.db.Create(rt).Error
+}
+
+// Revoke marks a single token as used.  Only one caller can win the race to
+// revoke a token, everyone else gets ErrRefreshTokenInvalid.
+func (rg *refreshTokenGorm) Revoke(id uint) error {
+	db := rg.db.Model(&RefreshToken{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		UpdateColumn("revoked_at", time.Now())
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrRefreshTokenInvalid
+	}
+	return nil
+}
+
+func (rg *refreshTokenGorm) RevokeSession(sessionID string) error {
+	return rg.db.Model(&RefreshToken{}).
+		Where("session_id = ? AND revoked_at IS NULL", sessionID).
+		UpdateColumn("revoked_at", time.Now()).Error
+}
+
+func (rg *refreshTokenGorm) RevokeUser(userID uint) error {
+	return rg.db.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		UpdateColumn("revoked_at", time.Now()).Error
+}
@@ -0,0 +1,314 @@
+package models
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// DefaultRelatedLimit is how many related lectures are returned when no
+	// limit is asked for.
+	DefaultRelatedLimit = 5
+	// MaxRelatedLimit is the most related lectures returned.
+	MaxRelatedLimit = 20
+
+	// relatedTopicWeight and relatedTermWeight share a related lecture's
+	// score between its topics and its transcript.
+	relatedTopicWeight = 0.6
+	relatedTermWeight  = 0.4
+
+	// relatedQueryTerms is how many of a lecture's most said words are used
+	// to find candidates by transcript, and relatedCandidates how many
+	// candidates each of topics and transcripts may add.
+	relatedQueryTerms = 30
+	relatedCandidates = 200
+)
+
+// RelatedVideo is a lecture similar to another.  TopicScore is the Jaccard
+// similarity of their topics and TermScore the cosine similarity of the
+// TF-IDF weighted words of their transcripts, both from 0 to 1.  Score
+// combines the two.
+type RelatedVideo struct {
+	Video        Video
+	Score        float64
+	TopicScore   float64
+	TermScore    float64
+	SharedTopics []string
+}
+
+type RelatedDB interface {
+	// Candidates returns live videos in the classes, other than the one
+	// excluded, worth scoring: up to limit sharing the most of topics, and
+	// up to limit whose transcripts best match terms.
+	Candidates(classIDs []uint, exclude uint, topics, terms []string, limit int) ([]Video, error)
+	// TermCounts counts how often each stemmed word is said in the
+	// transcripts of the videos.
+	TermCounts(videoIDs []uint) (map[uint]map[string]int, error)
+}
+
+type RelatedService interface {
+	// Related finds the lectures in the classes most similar to video, best
+	// first.
+	Related(video *Video, classIDs []uint, limit int) ([]RelatedVideo, error)
+}
+
+func NewRelatedService(db *gorm.DB) RelatedService {
+	return &relatedService{
+		RelatedDB: &relatedGorm{db},
+	}
+}
+
+var _ RelatedService = &relatedService{}
+
+type relatedService struct {
+	RelatedDB
+}
+
+// Related only scores lectures that share a topic with video or say its most
+// common words, so big classes are not read in full.  The candidates are the
+// corpus for inverse document frequency, so words said in every one of them
+// count for little.
+func (rs *relatedService) Related(video *Video, classIDs []uint, limit int) ([]RelatedVideo, error) {
+	if limit <= 0 {
+		limit = DefaultRelatedLimit
+	}
+	if limit > MaxRelatedLimit {
+		limit = MaxRelatedLimit
+	}
+	if len(classIDs) == 0 {
+		return []RelatedVideo{}, nil
+	}
+
+	counts, err := rs.TermCounts([]uint{video.ID})
+	if err != nil {
+		return nil, err
+	}
+	terms := topTerms(counts[video.ID], relatedQueryTerms)
+	candidates, err := rs.Candidates(classIDs, video.ID, video.Topics, terms, relatedCandidates)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return []RelatedVideo{}, nil
+	}
+	ids := make([]uint, 0, len(candidates)+1)
+	ids = append(ids, video.ID)
+	for _, c := range candidates {
+		ids = append(ids, c.ID)
+	}
+	counts, err = rs.TermCounts(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := tfidf(ids, counts)
+	source := vectors[video.ID]
+	related := []RelatedVideo{}
+	for _, c := range candidates {
+		shared, topicScore := jaccard(video.Topics, c.Topics)
+		termScore := cosine(source, vectors[c.ID])
+		score := relatedTopicWeight*topicScore + relatedTermWeight*termScore
+		if score <= 0 {
+			continue
+		}
+		related = append(related, RelatedVideo{
+			Video:        c,
+			Score:        score,
+			TopicScore:   topicScore,
+			TermScore:    termScore,
+			SharedTopics: shared,
+		})
+	}
+	sort.SliceStable(related, func(i, j int) bool {
+		return related[i].Score > related[j].Score
+	})
+	if len(related) > limit {
+		related = related[:limit]
+	}
+	return related, nil
+}
+
+// topTerms returns the n words with the highest counts, most said first.
+func topTerms(counts map[string]int, n int) []string {
+	terms := make([]string, 0, len(counts))
+	for term := range counts {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if counts[terms[i]] != counts[terms[j]] {
+			return counts[terms[i]] > counts[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > n {
+		terms = terms[:n]
+	}
+	return terms
+}
+
+// jaccard returns the topics a and b share, ignoring case, and the size of
+// that overlap over the size of all their topics together.
+func jaccard(a, b []string) ([]string, float64) {
+	inA := map[string]bool{}
+	for _, topic := range a {
+		inA[strings.ToLower(topic)] = true
+	}
+	union := len(inA)
+	shared := []string{}
+	seen := map[string]bool{}
+	for _, topic := range b {
+		key := strings.ToLower(topic)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if inA[key] {
+			shared = append(shared, topic)
+		} else {
+			union++
+		}
+	}
+	if union == 0 {
+		return shared, 0
+	}
+	return shared, float64(len(shared)) / float64(union)
+}
+
+// tfidf weighs every word of every document by how often the document says
+// it, dampened logarithmically, times how rare it is across the documents.
+// The rarity is smoothed so a word said in every document still counts a
+// little, which keeps small classes from scoring nothing.
+func tfidf(docs []uint, counts map[uint]map[string]int) map[uint]map[string]float64 {
+	df := map[string]int{}
+	for _, doc := range docs {
+		for term := range counts[doc] {
+			df[term]++
+		}
+	}
+	n := float64(len(docs))
+	vectors := map[uint]map[string]float64{}
+	for _, doc := range docs {
+		vector := map[string]float64{}
+		for term, count := range counts[doc] {
+			idf := math.Log((1+n)/(1+float64(df[term]))) + 1
+			vector[term] = (1 + math.Log(float64(count))) * idf
+		}
+		vectors[doc] = vector
+	}
+	return vectors
+}
+
+func cosine(a, b map[string]float64) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	var dot, normA, normB float64
+	for term, w := range a {
+		dot += w * b[term]
+		normA += w * w
+	}
+	for _, w := range b {
+		normB += w * w
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+var _ RelatedDB = &relatedGorm{}
+
+type relatedGorm struct {
+	db *gorm.DB
+}
+
+func (rg *relatedGorm) Candidates(classIDs []uint, exclude uint, topics, terms []string, limit int) ([]Video, error) {
+	live := rg.db.Table("videos v").
+		Where("v.class_id IN (?) AND v.id <> ? AND v.deleted_at IS NULL", classIDs, exclude).
+		Where("v.class_id IN (SELECT id FROM classes WHERE deleted_at IS NULL)")
+
+	ids := []uint{}
+	if len(topics) > 0 {
+		var byTopic []uint
+		err := live.Joins("CROSS JOIN unnest(v.topics) AS t(topic)").
+			Where("lower(t.topic) IN (?)", lowerAll(topics)).
+			Group("v.id").
+			Order("count(*) DESC, v.id").
+			Limit(limit).
+			Pluck("v.id", &byTopic).Error
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, byTopic...)
+	}
+	if len(terms) > 0 {
+		query := termsQuery(terms)
+		var byTerm []uint
+		err := live.Joins("JOIN transcript_segments s ON s.video_id = v.id").
+			Where("s.search_vector @@ ?::tsquery", query).
+			Group("v.id").
+			Order(gorm.Expr("sum(ts_rank(s.search_vector, ?::tsquery)) DESC, v.id", query)).
+			Limit(limit).
+			Pluck("v.id", &byTerm).Error
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, byTerm...)
+	}
+
+	videos := []Video{}
+	if len(ids) == 0 {
+		return videos, nil
+	}
+	if err := rg.db.Where("id IN (?)", ids).Find(&videos).Error; err != nil {
+		return nil, err
+	}
+	return videos, nil
+}
+
+// termsQuery builds a tsquery matching any of terms.  The terms come out of
+// search vectors, so they are already stemmed and only need quoting.
+func termsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		term = strings.Replace(term, `\`, `\\`, -1)
+		quoted[i] = "'" + strings.Replace(term, "'", "''", -1) + "'"
+	}
+	return strings.Join(quoted, " | ")
+}
+
+type termCount struct {
+	VideoID uint
+	Term    string
+	Count   int
+}
+
+// TermCounts reads the words out of the transcripts' search vectors, so they
+// are already stemmed and stripped of stop words.
+func (rg *relatedGorm) TermCounts(videoIDs []uint) (map[uint]map[string]int, error) {
+	rows := []termCount{}
+	err := rg.db.Raw(`
+		SELECT s.video_id, u.lexeme AS term, sum(coalesce(array_length(u.positions, 1), 1)) AS count
+		FROM transcript_segments s, unnest(s.search_vector) AS u
+		WHERE s.video_id IN (?)
+		GROUP BY s.video_id, u.lexeme`,
+		videoIDs).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := map[uint]map[string]int{}
+	for _, row := range rows {
+		if counts[row.VideoID] == nil {
+			counts[row.VideoID] = map[string]int{}
+		}
+		counts[row.VideoID][row.Term] = row.Count
+	}
+	return counts, nil
+}
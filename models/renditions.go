@@ -0,0 +1,275 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
+	"github.com/jinzhu/gorm"
+)
+
+// MaxRenditionNameLength is the longest a rendition name can be.
+const MaxRenditionNameLength = 50
+
+// Rendition is one encoding of a video for adaptive streaming, such as
+// "720p", made by the pipeline.  Bandwidth is its peak bits per second and
+// AverageBandwidth its average; Codecs is an RFC 6381 codecs list like
+// "avc1.64001f,mp4a.40.2".  Zero values are left out of playlists.
+type Rendition struct {
+	gorm.Model
+	VideoID          uint   `gorm:"not null;index"`
+	Name             string `gorm:"size:50;not null"`
+	Bandwidth        int    `gorm:"not null"`
+	AverageBandwidth int
+	Width            int
+	Height           int
+	Codecs           string `gorm:"size:200"`
+	FrameRate        float64
+}
+
+// RenditionSegment is one piece of a rendition, kept in the store under
+// ObjectKey.  Segments play in Sequence order.
+type RenditionSegment struct {
+	ID          uint   `gorm:"primary_key"`
+	RenditionID uint   `gorm:"not null;index:idx_rendition_segments_rendition_sequence"`
+	Sequence    int    `gorm:"not null;index:idx_rendition_segments_rendition_sequence"`
+	DurationMS  int64  `gorm:"not null"`
+	ObjectKey   string `gorm:"type:text;not null"`
+}
+
+type RenditionDB interface {
+	ByID(id uint) (*Rendition, error)
+	// ByVideo returns the renditions of a video from the lowest bandwidth to
+	// the highest.
+	ByVideo(videoID uint) ([]Rendition, error)
+	// Segments returns the segments of a rendition in play order.
+	Segments(renditionID uint) ([]RenditionSegment, error)
+
+	// Save adds a rendition and its segments, numbered in the order given.
+	// A rendition of the video with the same name is replaced.
+	Save(rendition *Rendition, segments []RenditionSegment) error
+	Delete(id uint) error
+}
+
+type RenditionService interface {
+	RenditionDB
+}
+
+// NewRenditionService returns a RenditionService whose segments must be
+// under their video's storage.ClassPrefix in keyPrefix.
+func NewRenditionService(db *gorm.DB, keyPrefix string) RenditionService {
+	rg := &renditionGorm{db}
+	return &renditionService{
+		RenditionDB: newRenditionValidator(rg, &videoGorm{db: db}, keyPrefix),
+	}
+}
+
+var _ RenditionService = &renditionService{}
+
+type renditionService struct {
+	RenditionDB
+}
+
+type renditionValFunc func(*Rendition) error
+
+func runRenditionValFuncs(rendition *Rendition, fns ...renditionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(rendition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ RenditionDB = &renditionValidator{}
+
+type renditionValidator struct {
+	RenditionDB
+	videos    VideoDB
+	keyPrefix string
+}
+
+func newRenditionValidator(rdb RenditionDB, videos VideoDB, keyPrefix string) *renditionValidator {
+	return &renditionValidator{
+		RenditionDB: rdb,
+		videos:      videos,
+		keyPrefix:   keyPrefix,
+	}
+}
+
+func (rv *renditionValidator) Save(rendition *Rendition, segments []RenditionSegment) error {
+	err := runRenditionValFuncs(rendition,
+		rv.requireVideoID,
+		rv.normalize,
+		rv.nameValid,
+		rv.bandwidthValid,
+		rv.dimensionsNotNegative,
+		rv.codecsValid)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return ErrRenditionSegmentsRequired
+	}
+	// Segments are signed for anyone who can see the class, so they must be
+	// its own objects
+	video, err := rv.videos.ByID(rendition.VideoID)
+	if err != nil {
+		return err
+	}
+	prefix := storage.ClassPrefix(rv.keyPrefix, video.ClassID)
+	for i := range segments {
+		if segments[i].DurationMS <= 0 {
+			return ErrRenditionSegmentInvalid
+		}
+		key, err := storage.CleanKey(strings.TrimSpace(segments[i].ObjectKey))
+		if err != nil {
+			return ErrRenditionSegmentInvalid
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return ErrRenditionSegmentKeyInvalid
+		}
+		segments[i].ObjectKey = key
+		segments[i].Sequence = i
+	}
+	return rv.RenditionDB.Save(rendition, segments)
+}
+
+func (rv *renditionValidator) Delete(id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	return rv.RenditionDB.Delete(id)
+}
+
+func (rv *renditionValidator) requireVideoID(rendition *Rendition) error {
+	if rendition.VideoID == 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (rv *renditionValidator) normalize(rendition *Rendition) error {
+	rendition.Name = strings.TrimSpace(rendition.Name)
+	rendition.Codecs = strings.Replace(rendition.Codecs, " ", "", -1)
+	return nil
+}
+
+func (rv *renditionValidator) nameValid(rendition *Rendition) error {
+	if rendition.Name == "" || len(rendition.Name) > MaxRenditionNameLength {
+		return ErrRenditionNameInvalid
+	}
+	return nil
+}
+
+func (rv *renditionValidator) bandwidthValid(rendition *Rendition) error {
+	if rendition.Bandwidth <= 0 || rendition.AverageBandwidth < 0 || rendition.AverageBandwidth > rendition.Bandwidth {
+		return ErrRenditionBandwidthInvalid
+	}
+	return nil
+}
+
+func (rv *renditionValidator) dimensionsNotNegative(rendition *Rendition) error {
+	if rendition.Width < 0 || rendition.Height < 0 || rendition.FrameRate < 0 {
+		return ErrRenditionDimensionsInvalid
+	}
+	return nil
+}
+
+// Codecs are written inside quotes in the master playlist
+func (rv *renditionValidator) codecsValid(rendition *Rendition) error {
+	if len(rendition.Codecs) > 200 || strings.ContainsAny(rendition.Codecs, "\"\r\n") {
+		return ErrRenditionCodecsInvalid
+	}
+	return nil
+}
+
+var _ RenditionDB = &renditionGorm{}
+
+type renditionGorm struct {
+	db *gorm.DB
+}
+
+func (rg *renditionGorm) ByID(id uint) (*Rendition, error) {
+	var rendition Rendition
+	err := first(rg.db.Where("id = ?", id), &rendition)
+	if err == ErrResourceNotFound {
+		return nil, ErrRenditionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rendition, nil
+}
+
+func (rg *renditionGorm) ByVideo(videoID uint) ([]Rendition, error) {
+	renditions := []Rendition{}
+	err := rg.db.Where("video_id = ?", videoID).
+		Order("bandwidth").Order("id").
+		Find(&renditions).Error
+	if err != nil {
+		return nil, err
+	}
+	return renditions, nil
+}
+
+func (rg *renditionGorm) Segments(renditionID uint) ([]RenditionSegment, error) {
+	segments := []RenditionSegment{}
+	err := rg.db.Where("rendition_id = ?", renditionID).
+		Order("sequence").
+		Find(&segments).Error
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+func (rg *renditionGorm) Save(rendition *Rendition, segments []RenditionSegment) error {
+	tx := rg.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	old := []Rendition{}
+	if err := tx.Where("video_id = ? AND name = ?", rendition.VideoID, rendition.Name).Find(&old).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, o := range old {
+		if err := deleteRendition(tx, o.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Create(rendition).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := range segments {
+		segments[i].RenditionID = rendition.ID
+		if err := tx.Create(&segments[i]).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (rg *renditionGorm) Delete(id uint) error {
+	tx := rg.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := deleteRendition(tx, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// deleteRendition removes a rendition and its segments for good; the
+// segments' objects are left to the pipeline that made them.
+func deleteRendition(tx *gorm.DB, id uint) error {
+	if err := tx.Where("rendition_id = ?", id).Delete(&RenditionSegment{}).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("id = ?", id).Delete(&Rendition{}).Error
+}
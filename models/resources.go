@@ -0,0 +1,352 @@
+package models
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Kinds of related resource.
+const (
+	ResourceArticle   = "article"
+	ResourceVideo     = "video"
+	ResourcePDF       = "pdf"
+	ResourceWorksheet = "worksheet"
+	ResourceOther     = "other"
+)
+
+// Where a related resource came from.
+const (
+	// ResourceOriginPipeline marks resources found by the lecture processing
+	// pipeline, including every one carried over from Video.Related_Resources.
+	ResourceOriginPipeline  = "pipeline"
+	ResourceOriginProfessor = "professor"
+	ResourceOriginStudent   = "student"
+)
+
+// MaxResourceTitleLength is the longest a resource title can be.
+const MaxResourceTitleLength = 200
+
+// Resource is further reading or viewing for a lecture.  It has a URL, a
+// title or both.  TimestampMS, when set, is the moment in the lecture the
+// resource goes with.  CreatedByID is the user who added it, zero for the
+// pipeline.
+type Resource struct {
+	gorm.Model
+	VideoID     uint   `gorm:"not null;index"`
+	URL         string `gorm:"type:text"`
+	Title       string `gorm:"size:200"`
+	Kind        string `gorm:"not null"`
+	Origin      string `gorm:"not null"`
+	TimestampMS *int64
+	CreatedByID uint
+}
+
+type ResourceDB interface {
+	ByID(id uint) (*Resource, error)
+	// ByVideo returns the resources of a video, those tied to a moment in
+	// time order, then the rest in the order they were added.
+	ByVideo(videoID uint) ([]Resource, error)
+
+	Create(resource *Resource) error
+	Update(resource *Resource) error
+	Delete(id uint) error
+}
+
+type ResourceService interface {
+	ResourceDB
+	// ImportLegacy adds a pipeline resource for every entry of the video's
+	// Related_Resources.  It only ever does so once per video, so resources
+	// an instructor has since edited or deleted stay that way.
+	ImportLegacy(video *Video) error
+}
+
+func NewResourceService(db *gorm.DB) ResourceService {
+	rg := &resourceGorm{db}
+	return &resourceService{
+		ResourceDB: newResourceValidator(rg),
+		db:         db,
+	}
+}
+
+var _ ResourceService = &resourceService{}
+
+type resourceService struct {
+	ResourceDB
+	db *gorm.DB
+}
+
+// ImportLegacy sorts each entry into a URL or, for plain text like "Chapter
+// 3 of CLRS", a title, then adds it like any other resource.  A video with
+// any pipeline resource, even a deleted one, has already been imported, the
+// same test migrateResources uses.
+func (rs *resourceService) ImportLegacy(video *Video) error {
+	if len(video.Related_Resources) == 0 {
+		return nil
+	}
+	var imported int
+	err := rs.db.Unscoped().Model(&Resource{}).
+		Where("video_id = ? AND origin = ?", video.ID, ResourceOriginPipeline).
+		Count(&imported).Error
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
+		return nil
+	}
+	for _, entry := range dedupeStrings(video.Related_Resources) {
+		resource := Resource{
+			VideoID: video.ID,
+			Origin:  ResourceOriginPipeline,
+		}
+		if isWebURL(entry) {
+			resource.URL = entry
+		} else {
+			resource.Title = entry
+		}
+		if err := rs.Create(&resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type resourceValFunc func(*Resource) error
+
+func runResourceValFuncs(resource *Resource, fns ...resourceValFunc) error {
+	for _, fn := range fns {
+		if err := fn(resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ ResourceDB = &resourceValidator{}
+
+type resourceValidator struct {
+	ResourceDB
+}
+
+func newResourceValidator(rdb ResourceDB) *resourceValidator {
+	return &resourceValidator{
+		ResourceDB: rdb,
+	}
+}
+
+func (rv *resourceValidator) Create(resource *Resource) error {
+	err := runResourceValFuncs(resource,
+		rv.requireVideoID,
+		rv.normalize,
+		rv.requireURLOrTitle,
+		rv.urlFormat,
+		rv.titleMaxLength,
+		rv.defaultKind,
+		rv.kindValid,
+		rv.originValid,
+		rv.timestampNotNegative)
+	if err != nil {
+		return err
+	}
+	return rv.ResourceDB.Create(resource)
+}
+
+func (rv *resourceValidator) Update(resource *Resource) error {
+	err := runResourceValFuncs(resource,
+		rv.idGreaterThan(0),
+		rv.requireVideoID,
+		rv.normalize,
+		rv.requireURLOrTitle,
+		rv.urlFormat,
+		rv.titleMaxLength,
+		rv.defaultKind,
+		rv.kindValid,
+		rv.originValid,
+		rv.timestampNotNegative)
+	if err != nil {
+		return err
+	}
+	return rv.ResourceDB.Update(resource)
+}
+
+func (rv *resourceValidator) Delete(id uint) error {
+	var resource Resource
+	resource.ID = id
+	if err := runResourceValFuncs(&resource, rv.idGreaterThan(0)); err != nil {
+		return err
+	}
+	return rv.ResourceDB.Delete(id)
+}
+
+func (rv *resourceValidator) idGreaterThan(n uint) resourceValFunc {
+	return resourceValFunc(func(resource *Resource) error {
+		if resource.ID <= n {
+			return ErrIDInvalid
+		}
+		return nil
+	})
+}
+
+func (rv *resourceValidator) requireVideoID(resource *Resource) error {
+	if resource.VideoID == 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (rv *resourceValidator) normalize(resource *Resource) error {
+	resource.URL = strings.TrimSpace(resource.URL)
+	resource.Title = strings.TrimSpace(resource.Title)
+	resource.Kind = strings.ToLower(strings.TrimSpace(resource.Kind))
+	resource.Origin = strings.ToLower(strings.TrimSpace(resource.Origin))
+	return nil
+}
+
+func (rv *resourceValidator) requireURLOrTitle(resource *Resource) error {
+	if resource.URL == "" && resource.Title == "" {
+		return ErrResourceRequired
+	}
+	return nil
+}
+
+// Resources are opened by the app, so they must be web links
+func (rv *resourceValidator) urlFormat(resource *Resource) error {
+	if resource.URL == "" {
+		return nil
+	}
+	if !isWebURL(resource.URL) {
+		return ErrResourceURLInvalid
+	}
+	return nil
+}
+
+func (rv *resourceValidator) titleMaxLength(resource *Resource) error {
+	if utf8.RuneCountInString(resource.Title) > MaxResourceTitleLength {
+		return ErrResourceTitleTooLong
+	}
+	return nil
+}
+
+// Guesses the kind of a resource from its link when none is given
+func (rv *resourceValidator) defaultKind(resource *Resource) error {
+	if resource.Kind != "" {
+		return nil
+	}
+	resource.Kind = guessResourceKind(resource.URL)
+	return nil
+}
+
+func (rv *resourceValidator) kindValid(resource *Resource) error {
+	switch resource.Kind {
+	case ResourceArticle, ResourceVideo, ResourcePDF, ResourceWorksheet, ResourceOther:
+		return nil
+	}
+	return ErrResourceKindInvalid
+}
+
+func (rv *resourceValidator) originValid(resource *Resource) error {
+	switch resource.Origin {
+	case ResourceOriginPipeline, ResourceOriginProfessor, ResourceOriginStudent:
+		return nil
+	}
+	return ErrResourceOriginInvalid
+}
+
+func (rv *resourceValidator) timestampNotNegative(resource *Resource) error {
+	if resource.TimestampMS != nil && *resource.TimestampMS < 0 {
+		return ErrResourceTimestampInvalid
+	}
+	return nil
+}
+
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+func guessResourceKind(link string) string {
+	if link == "" {
+		return ResourceOther
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ResourceOther
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	switch {
+	case strings.ToLower(path.Ext(u.Path)) == ".pdf":
+		return ResourcePDF
+	case host == "youtube.com" || host == "youtu.be" || host == "vimeo.com":
+		return ResourceVideo
+	}
+	return ResourceArticle
+}
+
+var _ ResourceDB = &resourceGorm{}
+
+type resourceGorm struct {
+	db *gorm.DB
+}
+
+func (rg *resourceGorm) ByID(id uint) (*Resource, error) {
+	var resource Resource
+	err := first(rg.db.Where("id = ?", id), &resource)
+	if err == ErrResourceNotFound {
+		return nil, ErrRelatedResourceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+func (rg *resourceGorm) ByVideo(videoID uint) ([]Resource, error) {
+	resources := []Resource{}
+	err := rg.db.Where("video_id = ?", videoID).
+		Order("timestamp_ms NULLS LAST").Order("id").
+		Find(&resources).Error
+	if err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+func (rg *resourceGorm) Create(resource *Resource) error {
+	return rg.db.Create(resource).Error
+}
+
+func (rg *resourceGorm) Update(resource *Resource) error {
+	return rg.db.Save(resource).Error
+}
+
+func (rg *resourceGorm) Delete(id uint) error {
+	var resource Resource
+	resource.ID = id
+	return rg.db.Delete(&resource).Error
+}
+
+// migrateResources carries every video's Related_Resources over into the
+// resources table.  Videos already carried over are skipped, so it is safe
+// to run on every start.
+func migrateResources(db *gorm.DB) error {
+	videos := []Video{}
+	err := db.Where("array_length(related_resources, 1) > 0").
+		Where("NOT EXISTS (SELECT 1 FROM resources r WHERE r.video_id = videos.id AND r.origin = ?)", ResourceOriginPipeline).
+		Find(&videos).Error
+	if err != nil {
+		return err
+	}
+	rs := NewResourceService(db)
+	for i := range videos {
+		if err := rs.ImportLegacy(&videos[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
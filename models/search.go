@@ -0,0 +1,326 @@
+package models
+
+import (
+	"html"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// DefaultSearchLimit is how many videos a search returns when no limit
+	// is asked for.
+	DefaultSearchLimit = 20
+	// MaxSearchLimit is the most videos returned in one page of results.
+	MaxSearchLimit = 100
+	// MaxSearchQueryLength is the longest search query accepted.
+	MaxSearchQueryLength = 200
+	// MaxSearchMatches is the most transcript matches returned per video.
+	MaxSearchMatches = 3
+	// headlineOptions marks matched words in snippets with characters from
+	// Unicode's private use area, which markHeadline turns into <mark> tags
+	// once the rest of the text is escaped.
+	headlineOptions = "StartSel=\"\uE000\", StopSel=\"\uE001\", MaxWords=25, MinWords=10, MaxFragments=2, FragmentDelimiter=\" … \""
+)
+
+// headlineMarker replaces the private use markers in an escaped headline.
+var headlineMarker = strings.NewReplacer("\uE000", "<mark>", "\uE001", "</mark>")
+
+// markHeadline HTML escapes the lecture text in a ts_headline result, so
+// only the <mark> tags around matched words are markup.
+func markHeadline(headline string) string {
+	return headlineMarker.Replace(html.EscapeString(headline))
+}
+
+// The tsvector columns are not fields on Video or TranscriptSegment, so gorm
+// never reads or writes them.  They are added by migrateSearch and refreshed
+// after every write.  Lecture titles and topics weigh the most, then the
+// description, then related resources.  Everything uses the english text
+// search configuration, which decides stemming and stop words.
+const (
+	videoSearchVector = `setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce(array_to_string(topics, ' '), '')), 'A') ||
+		setweight(to_tsvector('english', coalesce(description, '')), 'B') ||
+		setweight(to_tsvector('english', coalesce(array_to_string(related_resources, ' '), '')), 'C')`
+	transcriptSearchVector = `to_tsvector('english', text)`
+)
+
+// SearchOptions limits a search to some classes and pages through the
+// results.  RecordedFrom and RecordedTo limit it to lectures recorded in that
+// range, falling back to when the lecture was uploaded if it has no recording
+// date; RecordedTo is exclusive.
+type SearchOptions struct {
+	ClassIDs     []uint
+	RecordedFrom *time.Time
+	RecordedTo   *time.Time
+	Offset       int
+	Limit        int
+}
+
+// SearchResult is a video matching a search.  Highlight is the lecture title
+// and topics, HTML escaped, with matched words in <mark> tags, and Matches
+// are the best matching moments in its transcript, in time order.
+type SearchResult struct {
+	Video     Video
+	Rank      float64
+	Highlight string
+	Matches   []SearchMatch
+}
+
+// SearchMatch is a transcript segment matching a search.  Snippet is marked
+// up the same way as SearchResult.Highlight.
+type SearchMatch struct {
+	StartMS int64
+	EndMS   int64
+	Rank    float64
+	Snippet string
+}
+
+type SearchDB interface {
+	// Search runs a web style query: words are ANDed, "or" between words
+	// means either, quoted words must appear as a phrase and a leading "-"
+	// excludes a word.  Results are ordered best match first, and the total
+	// number of matching videos is returned with them.
+	Search(query string, opts SearchOptions) ([]SearchResult, int, error)
+}
+
+type SearchService interface {
+	SearchDB
+}
+
+func NewSearchService(db *gorm.DB) SearchService {
+	sg := &searchGorm{db}
+	return &searchService{
+		SearchDB: newSearchValidator(sg),
+	}
+}
+
+var _ SearchService = &searchService{}
+
+type searchService struct {
+	SearchDB
+}
+
+var _ SearchDB = &searchValidator{}
+
+type searchValidator struct {
+	SearchDB
+}
+
+func newSearchValidator(sdb SearchDB) *searchValidator {
+	return &searchValidator{
+		SearchDB: sdb,
+	}
+}
+
+func (sv *searchValidator) Search(query string, opts SearchOptions) ([]SearchResult, int, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, 0, ErrSearchQueryRequired
+	}
+	if utf8.RuneCountInString(query) > MaxSearchQueryLength {
+		return nil, 0, ErrSearchQueryTooLong
+	}
+	if len(opts.ClassIDs) == 0 {
+		return nil, 0, ErrClassIDRequired
+	}
+	if opts.RecordedFrom != nil && opts.RecordedTo != nil && !opts.RecordedTo.After(*opts.RecordedFrom) {
+		return nil, 0, ErrSearchDatesInvalid
+	}
+	if opts.Offset < 0 {
+		opts.Offset = 0
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultSearchLimit
+	}
+	if opts.Limit > MaxSearchLimit {
+		opts.Limit = MaxSearchLimit
+	}
+	return sv.SearchDB.Search(query, opts)
+}
+
+var _ SearchDB = &searchGorm{}
+
+type searchGorm struct {
+	db *gorm.DB
+}
+
+type searchHit struct {
+	ID    uint
+	Rank  float64
+	Total int
+}
+
+type searchHighlight struct {
+	ID        uint
+	Highlight string
+}
+
+type searchMatchRow struct {
+	VideoID uint
+	SearchMatch
+}
+
+// Search ranks a video by how well its own text matches plus how well its
+// best transcript segment matches, so a lecture that only mentions a word in
+// passing still turns up below lectures about it.
+func (sg *searchGorm) Search(query string, opts SearchOptions) ([]SearchResult, int, error) {
+	filters := ""
+	args := []interface{}{query, opts.ClassIDs}
+	if opts.RecordedFrom != nil {
+		filters += " AND coalesce(v.recorded_at, v.created_at) >= ?"
+		args = append(args, *opts.RecordedFrom)
+	}
+	if opts.RecordedTo != nil {
+		filters += " AND coalesce(v.recorded_at, v.created_at) < ?"
+		args = append(args, *opts.RecordedTo)
+	}
+
+	// Videos of deleted classes are left out along with deleted videos
+	hitsCTE := `
+		WITH q AS (SELECT websearch_to_tsquery('english', ?) AS query),
+		hits AS (
+			SELECT v.id,
+				coalesce(ts_rank(v.search_vector, q.query), 0) +
+				coalesce((SELECT max(ts_rank(s.search_vector, q.query))
+					FROM transcript_segments s
+					WHERE s.video_id = v.id AND s.search_vector @@ q.query), 0) AS rank
+			FROM videos v
+			JOIN classes c ON c.id = v.class_id AND c.deleted_at IS NULL, q
+			WHERE v.deleted_at IS NULL AND v.class_id IN (?)` + filters + `
+				AND (v.search_vector @@ q.query OR EXISTS (
+					SELECT 1 FROM transcript_segments s
+					WHERE s.video_id = v.id AND s.search_vector @@ q.query))
+		)`
+	hits := []searchHit{}
+	err := sg.db.Raw(hitsCTE+`
+		SELECT id, rank, count(*) OVER () AS total
+		FROM hits
+		ORDER BY rank DESC, id
+		LIMIT ? OFFSET ?`,
+		append(args, opts.Limit, opts.Offset)...).
+		Scan(&hits).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(hits) == 0 {
+		// A page past the last one has no row to carry the total
+		total := 0
+		if opts.Offset > 0 {
+			row := sg.db.Raw(hitsCTE+` SELECT count(*) FROM hits`, args...).Row()
+			if err := row.Scan(&total); err != nil {
+				return nil, 0, err
+			}
+		}
+		return []SearchResult{}, total, nil
+	}
+
+	ids := make([]uint, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.ID
+	}
+
+	videos := []Video{}
+	if err := sg.db.Where("id IN (?)", ids).Find(&videos).Error; err != nil {
+		return nil, 0, err
+	}
+	byID := map[uint]Video{}
+	for _, video := range videos {
+		byID[video.ID] = video
+	}
+
+	highlights := []searchHighlight{}
+	err = sg.db.Raw(`
+		SELECT id, ts_headline('english', concat_ws(' · ', nullif(title, ''), array_to_string(topics, ', ')),
+			websearch_to_tsquery('english', ?), ?) AS highlight
+		FROM videos
+		WHERE id IN (?)`,
+		query, headlineOptions, ids).
+		Scan(&highlights).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	highlightByID := map[uint]string{}
+	for _, h := range highlights {
+		highlightByID[h.ID] = markHeadline(h.Highlight)
+	}
+
+	matches := []searchMatchRow{}
+	err = sg.db.Raw(`
+		SELECT m.video_id, m.start_ms, m.end_ms, m.rank,
+			ts_headline('english', m.text, websearch_to_tsquery('english', ?), ?) AS snippet
+		FROM (
+			SELECT s.video_id, s.start_ms, s.end_ms, s.text,
+				ts_rank(s.search_vector, q.query) AS rank,
+				row_number() OVER (PARTITION BY s.video_id
+					ORDER BY ts_rank(s.search_vector, q.query) DESC, s.start_ms) AS n
+			FROM transcript_segments s, websearch_to_tsquery('english', ?) AS q(query)
+			WHERE s.video_id IN (?) AND s.search_vector @@ q.query
+		) m
+		WHERE m.n <= ?
+		ORDER BY m.video_id, m.start_ms`,
+		query, headlineOptions, query, ids, MaxSearchMatches).
+		Scan(&matches).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	matchesByID := map[uint][]SearchMatch{}
+	for _, m := range matches {
+		m.Snippet = markHeadline(m.Snippet)
+		matchesByID[m.VideoID] = append(matchesByID[m.VideoID], m.SearchMatch)
+	}
+
+	results := make([]SearchResult, 0, len(hits))
+	for _, hit := range hits {
+		video, ok := byID[hit.ID]
+		if !ok {
+			continue
+		}
+		result := SearchResult{
+			Video:     video,
+			Rank:      hit.Rank,
+			Highlight: highlightByID[hit.ID],
+			Matches:   matchesByID[hit.ID],
+		}
+		if result.Matches == nil {
+			result.Matches = []SearchMatch{}
+		}
+		results = append(results, result)
+	}
+	return results, hits[0].Total, nil
+}
+
+// migrateSearch turns on pg_trgm for fuzzy topic matching, adds the tsvector
+// columns and their GIN indexes, then fills in any rows written before they
+// existed.
+func migrateSearch(db *gorm.DB) error {
+	stmts := []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`ALTER TABLE videos ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+		`CREATE INDEX IF NOT EXISTS idx_videos_search_vector ON videos USING GIN (search_vector)`,
+		`UPDATE videos SET search_vector = ` + videoSearchVector + ` WHERE search_vector IS NULL`,
+		`ALTER TABLE transcript_segments ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+		`CREATE INDEX IF NOT EXISTS idx_transcript_segments_search_vector ON transcript_segments USING GIN (search_vector)`,
+		`UPDATE transcript_segments SET search_vector = ` + transcriptSearchVector + ` WHERE search_vector IS NULL`,
+	}
+	for _, stmt := range stmts {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshVideoSearch recomputes the search vector of a video after its text
+// changes.
+func refreshVideoSearch(db *gorm.DB, videoID uint) error {
+	return db.Exec(`UPDATE videos SET search_vector = `+videoSearchVector+` WHERE id = ?`, videoID).Error
+}
+
+// refreshTranscriptSearch computes the search vectors of a video's
+// transcript segments.
+func refreshTranscriptSearch(db *gorm.DB, videoID uint) error {
+	return db.Exec(`UPDATE transcript_segments SET search_vector = `+transcriptSearchVector+` WHERE video_id = ?`, videoID).Error
+}
@@ -1,15 +1,26 @@
 package models
 
 import (
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
 type Services struct {
-	db    *gorm.DB
-	User  UserService
-	Class ClassService
-	Video VideoService
+	db           *gorm.DB
+	User         UserService
+	RefreshToken RefreshTokenService
+	Class        ClassService
+	Enrollment   EnrollmentService
+	Video        VideoService
+	Transcript   TranscriptService
+	Topic        TopicOccurrenceService
+	Search       SearchService
+	ClassTopic   ClassTopicService
+	Related      RelatedService
+	Resource     ResourceService
+	Upload       UploadService
+	Rendition    RenditionService
 }
 
 type ServicesConfig func(*Services) error
@@ -32,9 +43,16 @@ func WithLogMode(mode bool) ServicesConfig {
 	}
 }
 
-func WithUser(pepper string) ServicesConfig {
+func WithUser(pepper string, resetSecret []byte) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper)
+		s.User = NewUserService(s.db, pepper, resetSecret)
+		return nil
+	}
+}
+
+func WithRefreshToken(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.RefreshToken = NewRefreshTokenService(s.db, hmacKey)
 		return nil
 	}
 }
@@ -46,9 +64,72 @@ func WithClass() ServicesConfig {
 	}
 }
 
-func WithVideo() ServicesConfig {
+func WithEnrollment() ServicesConfig {
+	return func(s *Services) error {
+		s.Enrollment = NewEnrollmentService(s.db)
+		return nil
+	}
+}
+
+func WithVideo(similarity float64, store storage.BlobStore, keyPrefix string) ServicesConfig {
+	return func(s *Services) error {
+		s.Video = NewVideoService(s.db, similarity, store, keyPrefix)
+		return nil
+	}
+}
+
+func WithTranscript() ServicesConfig {
+	return func(s *Services) error {
+		s.Transcript = NewTranscriptService(s.db)
+		return nil
+	}
+}
+
+func WithTopicOccurrence() ServicesConfig {
+	return func(s *Services) error {
+		s.Topic = NewTopicOccurrenceService(s.db)
+		return nil
+	}
+}
+
+func WithSearch() ServicesConfig {
+	return func(s *Services) error {
+		s.Search = NewSearchService(s.db)
+		return nil
+	}
+}
+
+func WithClassTopic() ServicesConfig {
+	return func(s *Services) error {
+		s.ClassTopic = NewClassTopicService(s.db)
+		return nil
+	}
+}
+
+func WithRelated() ServicesConfig {
+	return func(s *Services) error {
+		s.Related = NewRelatedService(s.db)
+		return nil
+	}
+}
+
+func WithResource() ServicesConfig {
+	return func(s *Services) error {
+		s.Resource = NewResourceService(s.db)
+		return nil
+	}
+}
+
+func WithUpload(maxSize int64, types []string) ServicesConfig {
+	return func(s *Services) error {
+		s.Upload = NewUploadService(s.db, maxSize, types)
+		return nil
+	}
+}
+
+func WithRendition(keyPrefix string) ServicesConfig {
 	return func(s *Services) error {
-		s.Video = NewVideoService(s.db)
+		s.Rendition = NewRenditionService(s.db, keyPrefix)
 		return nil
 	}
 }
@@ -69,7 +150,7 @@ func (s *Services) Close() error {
 }
 
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}).Error
+	err := s.db.DropTableIfExists(&User{}, &RefreshToken{}).Error
 	if err != nil {
 		return nil
 	}
@@ -78,5 +159,21 @@ func (s *Services) DestructiveReset() error {
 
 // Attempts to migrate User, InboundVehicle, and OutboundVehicle
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Class{}, &Video{}).Error
+	err := s.db.AutoMigrate(&User{}, &RefreshToken{}, &Class{}, &Enrollment{}, &Video{}, &TranscriptSegment{}, &TopicOccurrence{}, &ClassTopic{}, &Resource{}, &Upload{}, &Rendition{}, &RenditionSegment{}).Error
+	if err != nil {
+		return err
+	}
+	if err := migrateClasses(s.db); err != nil {
+		return err
+	}
+	if err := migrateResources(s.db); err != nil {
+		return err
+	}
+	if err := migrateClassTopics(s.db); err != nil {
+		return err
+	}
+	if err := s.Video.AssignObjectKeys(); err != nil {
+		return err
+	}
+	return migrateSearch(s.db)
 }
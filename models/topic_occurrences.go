@@ -0,0 +1,214 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+// TopicOccurrence records where in a video a topic is discussed.  Times are
+// milliseconds from the start of the recording.  Video.Topics still holds the
+// distinct topic names; occurrences add the timestamps.
+type TopicOccurrence struct {
+	ID      uint   `gorm:"primary_key"`
+	VideoID uint   `gorm:"not null;index"`
+	Topic   string `gorm:"type:varchar(200);not null"`
+	StartMS int64  `gorm:"not null"`
+	EndMS   int64  `gorm:"not null"`
+}
+
+type TopicOccurrenceDB interface {
+	ByVideo(videoID uint) ([]TopicOccurrence, error)
+	// ByVideosAndTopics returns the occurrences of any of topics, ignoring
+	// case, in any of the videos, in time order.
+	ByVideosAndTopics(videoIDs []uint, topics []string) ([]TopicOccurrence, error)
+
+	// ReplaceForVideo swaps every occurrence in a video for occurrences.
+	ReplaceForVideo(videoID uint, occurrences []TopicOccurrence) error
+	// KeepTopics deletes the occurrences in a video whose topic is not one
+	// of topics.
+	KeepTopics(videoID uint, topics []string) error
+}
+
+type TopicOccurrenceService interface {
+	TopicOccurrenceDB
+	// Check runs the checks ReplaceForVideo does on occurrences without
+	// saving them.
+	Check(occurrences []TopicOccurrence) error
+}
+
+func NewTopicOccurrenceService(db *gorm.DB) TopicOccurrenceService {
+	og := &topicOccurrenceGorm{db}
+	ov := newTopicOccurrenceValidator(og)
+	return &topicOccurrenceService{
+		TopicOccurrenceDB: ov,
+		validator:         ov,
+	}
+}
+
+var _ TopicOccurrenceService = &topicOccurrenceService{}
+
+type topicOccurrenceService struct {
+	TopicOccurrenceDB
+	validator *topicOccurrenceValidator
+}
+
+func (tos *topicOccurrenceService) Check(occurrences []TopicOccurrence) error {
+	return tos.validator.check(occurrences)
+}
+
+type topicOccurrenceValFunc func(*TopicOccurrence) error
+
+func runTopicOccurrenceValFuncs(occurrence *TopicOccurrence, fns ...topicOccurrenceValFunc) error {
+	for _, fn := range fns {
+		if err := fn(occurrence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ TopicOccurrenceDB = &topicOccurrenceValidator{}
+
+type topicOccurrenceValidator struct {
+	TopicOccurrenceDB
+}
+
+func newTopicOccurrenceValidator(odb TopicOccurrenceDB) *topicOccurrenceValidator {
+	return &topicOccurrenceValidator{
+		TopicOccurrenceDB: odb,
+	}
+}
+
+func (ov *topicOccurrenceValidator) ReplaceForVideo(videoID uint, occurrences []TopicOccurrence) error {
+	if videoID == 0 {
+		return ErrIDInvalid
+	}
+	if err := ov.check(occurrences); err != nil {
+		return err
+	}
+	for i := range occurrences {
+		occurrences[i].VideoID = videoID
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].StartMS < occurrences[j].StartMS
+	})
+	return ov.TopicOccurrenceDB.ReplaceForVideo(videoID, occurrences)
+}
+
+func (ov *topicOccurrenceValidator) check(occurrences []TopicOccurrence) error {
+	for i := range occurrences {
+		err := runTopicOccurrenceValFuncs(&occurrences[i],
+			ov.normalizeTopic,
+			ov.requireTopic,
+			ov.topicMaxLength,
+			ov.timesValid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ov *topicOccurrenceValidator) ByVideosAndTopics(videoIDs []uint, topics []string) ([]TopicOccurrence, error) {
+	if len(videoIDs) == 0 || len(topics) == 0 {
+		return []TopicOccurrence{}, nil
+	}
+	return ov.TopicOccurrenceDB.ByVideosAndTopics(videoIDs, lowerAll(topics))
+}
+
+func (ov *topicOccurrenceValidator) KeepTopics(videoID uint, topics []string) error {
+	return ov.TopicOccurrenceDB.KeepTopics(videoID, lowerAll(topics))
+}
+
+func (ov *topicOccurrenceValidator) normalizeTopic(occurrence *TopicOccurrence) error {
+	occurrence.Topic = strings.TrimSpace(occurrence.Topic)
+	return nil
+}
+
+func (ov *topicOccurrenceValidator) requireTopic(occurrence *TopicOccurrence) error {
+	if occurrence.Topic == "" {
+		return ErrTopicRequired
+	}
+	return nil
+}
+
+func (ov *topicOccurrenceValidator) topicMaxLength(occurrence *TopicOccurrence) error {
+	if utf8.RuneCountInString(occurrence.Topic) > MaxTopicLength {
+		return ErrTopicTooLong
+	}
+	return nil
+}
+
+func (ov *topicOccurrenceValidator) timesValid(occurrence *TopicOccurrence) error {
+	if occurrence.StartMS < 0 || occurrence.EndMS < occurrence.StartMS {
+		return ErrTopicTimesInvalid
+	}
+	return nil
+}
+
+func lowerAll(in []string) []string {
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = strings.ToLower(strings.TrimSpace(s))
+	}
+	return out
+}
+
+var _ TopicOccurrenceDB = &topicOccurrenceGorm{}
+
+type topicOccurrenceGorm struct {
+	db *gorm.DB
+}
+
+func (og *topicOccurrenceGorm) ByVideo(videoID uint) ([]TopicOccurrence, error) {
+	occurrences := []TopicOccurrence{}
+	err := og.db.Where("video_id = ?", videoID).
+		Order("start_ms").Order("id").
+		Find(&occurrences).Error
+	if err != nil {
+		return nil, err
+	}
+	return occurrences, nil
+}
+
+// ByVideosAndTopics expects topics to already be lower case.
+func (og *topicOccurrenceGorm) ByVideosAndTopics(videoIDs []uint, topics []string) ([]TopicOccurrence, error) {
+	occurrences := []TopicOccurrence{}
+	err := og.db.Where("video_id IN (?) AND lower(topic) IN (?)", videoIDs, topics).
+		Order("video_id").Order("start_ms").Order("id").
+		Find(&occurrences).Error
+	if err != nil {
+		return nil, err
+	}
+	return occurrences, nil
+}
+
+func (og *topicOccurrenceGorm) ReplaceForVideo(videoID uint, occurrences []TopicOccurrence) error {
+	tx := og.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Where("video_id = ?", videoID).Delete(&TopicOccurrence{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := range occurrences {
+		if err := tx.Create(&occurrences[i]).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// KeepTopics expects topics to already be lower case.
+func (og *topicOccurrenceGorm) KeepTopics(videoID uint, topics []string) error {
+	db := og.db.Where("video_id = ?", videoID)
+	if len(topics) > 0 {
+		db = db.Where("lower(topic) NOT IN (?)", topics)
+	}
+	return db.Delete(&TopicOccurrence{}).Error
+}
@@ -0,0 +1,242 @@
+package models
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// DefaultTranscriptLimit is how many segments are returned when no limit
+	// is asked for.
+	DefaultTranscriptLimit = 100
+	// MaxTranscriptLimit is the most segments returned in one page.
+	MaxTranscriptLimit = 500
+)
+
+// TranscriptSegment is one stretch of speech-to-text output for a video.
+// Times are milliseconds from the start of the recording and Confidence is
+// the recognizer's score between 0 and 1.
+type TranscriptSegment struct {
+	ID         uint    `gorm:"primary_key"`
+	VideoID    uint    `gorm:"not null;index:idx_transcript_segments_video_start"`
+	StartMS    int64   `gorm:"not null;index:idx_transcript_segments_video_start"`
+	EndMS      int64   `gorm:"not null"`
+	Text       string  `gorm:"type:text;not null"`
+	Confidence float64 `gorm:"not null"`
+}
+
+// TranscriptOptions picks which segments of a transcript to return.  When
+// FromMS or ToMS is set only segments overlapping that window are returned;
+// Offset and Limit then page through the result.
+type TranscriptOptions struct {
+	FromMS int64
+	ToMS   int64
+	Offset int
+	Limit  int
+}
+
+type TranscriptDB interface {
+	// ByVideo returns the matching segments in time order, along with how
+	// many segments match in total.
+	ByVideo(videoID uint, opts TranscriptOptions) ([]TranscriptSegment, int, error)
+	// AllByVideo returns the whole transcript in time order.
+	AllByVideo(videoID uint) ([]TranscriptSegment, error)
+
+	// ReplaceForVideo swaps the whole transcript of a video for segments.
+	ReplaceForVideo(videoID uint, segments []TranscriptSegment) error
+	DeleteByVideo(videoID uint) error
+}
+
+type TranscriptService interface {
+	TranscriptDB
+	// Check runs the checks ReplaceForVideo does on segments without saving
+	// them.
+	Check(segments []TranscriptSegment) error
+}
+
+func NewTranscriptService(db *gorm.DB) TranscriptService {
+	tg := &transcriptGorm{db}
+	tv := newTranscriptValidator(tg)
+	return &transcriptService{
+		TranscriptDB: tv,
+		validator:    tv,
+	}
+}
+
+var _ TranscriptService = &transcriptService{}
+
+type transcriptService struct {
+	TranscriptDB
+	validator *transcriptValidator
+}
+
+func (ts *transcriptService) Check(segments []TranscriptSegment) error {
+	return ts.validator.check(segments)
+}
+
+type transcriptValFunc func(*TranscriptSegment) error
+
+func runTranscriptValFuncs(segment *TranscriptSegment, fns ...transcriptValFunc) error {
+	for _, fn := range fns {
+		if err := fn(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ TranscriptDB = &transcriptValidator{}
+
+type transcriptValidator struct {
+	TranscriptDB
+}
+
+func newTranscriptValidator(tdb TranscriptDB) *transcriptValidator {
+	return &transcriptValidator{
+		TranscriptDB: tdb,
+	}
+}
+
+func (tv *transcriptValidator) ByVideo(videoID uint, opts TranscriptOptions) ([]TranscriptSegment, int, error) {
+	if opts.FromMS < 0 || opts.ToMS < 0 || (opts.ToMS > 0 && opts.ToMS <= opts.FromMS) {
+		return nil, 0, ErrTranscriptWindowInvalid
+	}
+	if opts.Offset < 0 {
+		opts.Offset = 0
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultTranscriptLimit
+	}
+	if opts.Limit > MaxTranscriptLimit {
+		opts.Limit = MaxTranscriptLimit
+	}
+	return tv.TranscriptDB.ByVideo(videoID, opts)
+}
+
+// ReplaceForVideo checks every segment, then stores them in time order.
+func (tv *transcriptValidator) ReplaceForVideo(videoID uint, segments []TranscriptSegment) error {
+	if videoID == 0 {
+		return ErrIDInvalid
+	}
+	if err := tv.check(segments); err != nil {
+		return err
+	}
+	for i := range segments {
+		segments[i].VideoID = videoID
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].StartMS < segments[j].StartMS
+	})
+	return tv.TranscriptDB.ReplaceForVideo(videoID, segments)
+}
+
+func (tv *transcriptValidator) check(segments []TranscriptSegment) error {
+	for i := range segments {
+		err := runTranscriptValFuncs(&segments[i],
+			tv.normalizeText,
+			tv.requireText,
+			tv.timesValid,
+			tv.confidenceValid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tv *transcriptValidator) normalizeText(segment *TranscriptSegment) error {
+	segment.Text = strings.TrimSpace(segment.Text)
+	return nil
+}
+
+func (tv *transcriptValidator) requireText(segment *TranscriptSegment) error {
+	if segment.Text == "" {
+		return ErrTranscriptTextRequired
+	}
+	return nil
+}
+
+func (tv *transcriptValidator) timesValid(segment *TranscriptSegment) error {
+	if segment.StartMS < 0 || segment.EndMS < segment.StartMS {
+		return ErrTranscriptTimesInvalid
+	}
+	return nil
+}
+
+func (tv *transcriptValidator) confidenceValid(segment *TranscriptSegment) error {
+	if segment.Confidence < 0 || segment.Confidence > 1 {
+		return ErrTranscriptConfidenceInvalid
+	}
+	return nil
+}
+
+var _ TranscriptDB = &transcriptGorm{}
+
+type transcriptGorm struct {
+	db *gorm.DB
+}
+
+func (tg *transcriptGorm) ByVideo(videoID uint, opts TranscriptOptions) ([]TranscriptSegment, int, error) {
+	db := tg.db.Model(&TranscriptSegment{}).Where("video_id = ?", videoID)
+	if opts.FromMS > 0 {
+		db = db.Where("end_ms > ?", opts.FromMS)
+	}
+	if opts.ToMS > 0 {
+		db = db.Where("start_ms < ?", opts.ToMS)
+	}
+
+	var total int
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	segments := []TranscriptSegment{}
+	err := db.Order("start_ms").Order("id").
+		Offset(opts.Offset).Limit(opts.Limit).
+		Find(&segments).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return segments, total, nil
+}
+
+func (tg *transcriptGorm) AllByVideo(videoID uint) ([]TranscriptSegment, error) {
+	segments := []TranscriptSegment{}
+	err := tg.db.Where("video_id = ?", videoID).
+		Order("start_ms").Order("id").
+		Find(&segments).Error
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// ReplaceForVideo deletes the old transcript and inserts the new one in a
+// single transaction, so readers never see half a transcript.
+func (tg *transcriptGorm) ReplaceForVideo(videoID uint, segments []TranscriptSegment) error {
+	tx := tg.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Where("video_id = ?", videoID).Delete(&TranscriptSegment{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := range segments {
+		if err := tx.Create(&segments[i]).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := refreshTranscriptSearch(tx, videoID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (tg *transcriptGorm) DeleteByVideo(videoID uint) error {
+	return tg.db.Where("video_id = ?", videoID).Delete(&TranscriptSegment{}).Error
+}
@@ -0,0 +1,323 @@
+package models
+
+import (
+	"encoding/hex"
+	"mime"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// DefaultMaxUploadSize is the largest recording that can be uploaded
+	// when no limit is configured, 4 GiB.
+	DefaultMaxUploadSize int64 = 4 << 30
+	// MaxUploadFilenameLength is the longest an uploaded file's name can be.
+	MaxUploadFilenameLength = 200
+)
+
+// DefaultUploadTypes are the kinds of recording that can be uploaded when
+// none are configured.
+var DefaultUploadTypes = []string{
+	"video/mp4",
+	"video/quicktime",
+	"video/webm",
+	"audio/mpeg",
+	"audio/mp4",
+	"audio/wav",
+}
+
+// uploadTypeAliases are the other names some browsers and
+// http.DetectContentType give types, mapped to the one uploads are kept as.
+var uploadTypeAliases = map[string]string{
+	"audio/wave":     "audio/wav",
+	"audio/x-wav":    "audio/wav",
+	"audio/vnd.wave": "audio/wav",
+	"audio/x-m4a":    "audio/mp4",
+	"audio/mp3":      "audio/mpeg",
+}
+
+// canonicalType lowercases a content type and replaces an alias with the
+// name it is kept as.
+func canonicalType(contentType string) string {
+	t := strings.ToLower(strings.TrimSpace(contentType))
+	if alias, ok := uploadTypeAliases[t]; ok {
+		return alias
+	}
+	return t
+}
+
+// Upload is a recording being sent to the server a chunk at a time.  Offset
+// is how many of its Size bytes have arrived, and SHA256 the hex digest the
+// whole file must have.  VideoID is set once the upload is complete and its
+// video created.
+type Upload struct {
+	gorm.Model
+	ClassID     uint   `gorm:"not null"`
+	UserID      uint   `gorm:"not null;index"`
+	Filename    string `gorm:"size:200"`
+	Title       string `gorm:"size:200"`
+	ContentType string `gorm:"not null"`
+	Size        int64  `gorm:"not null"`
+	Offset      int64  `gorm:"not null"`
+	SHA256      string `gorm:"not null"`
+	VideoID     uint
+}
+
+// Done reports whether every byte of the upload has arrived.
+func (u *Upload) Done() bool {
+	return u.Offset == u.Size
+}
+
+type UploadDB interface {
+	ByID(id uint) (*Upload, error)
+	// Stale returns the uploads, finished or not, last changed before
+	// before.
+	Stale(before time.Time) ([]Upload, error)
+
+	Create(upload *Upload) error
+	Update(upload *Upload) error
+	Delete(id uint) error
+}
+
+type UploadService interface {
+	UploadDB
+	// Check applies the size and type limits to a file about to be uploaded
+	// without saving anything.
+	Check(upload *Upload) error
+	// MaxSize is the largest file that can be uploaded.
+	MaxSize() int64
+	// AllowsType reports whether files of a content type can be uploaded.
+	AllowsType(contentType string) bool
+}
+
+// NewUploadService returns an UploadService accepting files of at most
+// maxSize bytes whose type is one of types.  Zero values mean
+// DefaultMaxUploadSize and DefaultUploadTypes.
+func NewUploadService(db *gorm.DB, maxSize int64, types []string) UploadService {
+	if maxSize == 0 {
+		maxSize = DefaultMaxUploadSize
+	}
+	if len(types) == 0 {
+		types = DefaultUploadTypes
+	}
+	ug := &uploadGorm{db}
+	uv := newUploadValidator(ug, maxSize, types)
+	return &uploadService{
+		UploadDB:  uv,
+		validator: uv,
+	}
+}
+
+var _ UploadService = &uploadService{}
+
+type uploadService struct {
+	UploadDB
+	validator *uploadValidator
+}
+
+// Check runs the checks on the file a new upload goes through.
+func (us *uploadService) Check(upload *Upload) error {
+	return runUploadValFuncs(upload, us.validator.fileChecks()...)
+}
+
+func (us *uploadService) MaxSize() int64 {
+	return us.validator.maxSize
+}
+
+func (us *uploadService) AllowsType(contentType string) bool {
+	return us.validator.types[canonicalType(contentType)]
+}
+
+type uploadValFunc func(*Upload) error
+
+func runUploadValFuncs(upload *Upload, fns ...uploadValFunc) error {
+	for _, fn := range fns {
+		if err := fn(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ UploadDB = &uploadValidator{}
+
+type uploadValidator struct {
+	UploadDB
+	maxSize int64
+	types   map[string]bool
+}
+
+func newUploadValidator(udb UploadDB, maxSize int64, types []string) *uploadValidator {
+	allowed := map[string]bool{}
+	for _, t := range types {
+		allowed[canonicalType(t)] = true
+	}
+	return &uploadValidator{
+		UploadDB: udb,
+		maxSize:  maxSize,
+		types:    allowed,
+	}
+}
+
+// fileChecks are the checks on the file itself, shared by chunked uploads
+// and ones sent whole.
+func (uv *uploadValidator) fileChecks() []uploadValFunc {
+	return []uploadValFunc{
+		uv.normalize,
+		uv.filenameValid,
+		uv.titleMaxLength,
+		uv.sizeInRange,
+		uv.contentTypeAllowed,
+		uv.checksumFormat,
+	}
+}
+
+func (uv *uploadValidator) Create(upload *Upload) error {
+	fns := append([]uploadValFunc{uv.requireIDs}, uv.fileChecks()...)
+	fns = append(fns, uv.offsetInRange)
+	if err := runUploadValFuncs(upload, fns...); err != nil {
+		return err
+	}
+	return uv.UploadDB.Create(upload)
+}
+
+func (uv *uploadValidator) Update(upload *Upload) error {
+	fns := append([]uploadValFunc{uv.idGreaterThan(0), uv.requireIDs}, uv.fileChecks()...)
+	fns = append(fns, uv.offsetInRange)
+	if err := runUploadValFuncs(upload, fns...); err != nil {
+		return err
+	}
+	return uv.UploadDB.Update(upload)
+}
+
+func (uv *uploadValidator) Delete(id uint) error {
+	var upload Upload
+	upload.ID = id
+	if err := runUploadValFuncs(&upload, uv.idGreaterThan(0)); err != nil {
+		return err
+	}
+	return uv.UploadDB.Delete(id)
+}
+
+func (uv *uploadValidator) idGreaterThan(n uint) uploadValFunc {
+	return uploadValFunc(func(upload *Upload) error {
+		if upload.ID <= n {
+			return ErrIDInvalid
+		}
+		return nil
+	})
+}
+
+func (uv *uploadValidator) requireIDs(upload *Upload) error {
+	if upload.ClassID == 0 {
+		return ErrClassIDRequired
+	}
+	if upload.UserID == 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+// Only the base name of the file is kept, and parameters like charset are
+// dropped from its type, which is kept under its canonical name
+func (uv *uploadValidator) normalize(upload *Upload) error {
+	upload.Filename = path.Base(strings.Replace(strings.TrimSpace(upload.Filename), `\`, "/", -1))
+	if upload.Filename == "." || upload.Filename == "/" {
+		upload.Filename = ""
+	}
+	upload.Title = strings.TrimSpace(upload.Title)
+	if t, _, err := mime.ParseMediaType(upload.ContentType); err == nil {
+		upload.ContentType = t
+	}
+	upload.ContentType = canonicalType(upload.ContentType)
+	upload.SHA256 = strings.ToLower(strings.TrimSpace(upload.SHA256))
+	return nil
+}
+
+func (uv *uploadValidator) filenameValid(upload *Upload) error {
+	if upload.Filename == "" || utf8.RuneCountInString(upload.Filename) > MaxUploadFilenameLength {
+		return ErrUploadFilenameInvalid
+	}
+	return nil
+}
+
+func (uv *uploadValidator) titleMaxLength(upload *Upload) error {
+	if utf8.RuneCountInString(upload.Title) > MaxVideoTitleLength {
+		return ErrVideoTitleTooLong
+	}
+	return nil
+}
+
+func (uv *uploadValidator) sizeInRange(upload *Upload) error {
+	if upload.Size <= 0 {
+		return ErrUploadEmpty
+	}
+	if upload.Size > uv.maxSize {
+		return ErrUploadTooLarge
+	}
+	return nil
+}
+
+func (uv *uploadValidator) contentTypeAllowed(upload *Upload) error {
+	if !uv.types[upload.ContentType] {
+		return ErrUploadTypeInvalid
+	}
+	return nil
+}
+
+func (uv *uploadValidator) checksumFormat(upload *Upload) error {
+	b, err := hex.DecodeString(upload.SHA256)
+	if err != nil || len(b) != 32 {
+		return ErrUploadChecksumInvalid
+	}
+	return nil
+}
+
+func (uv *uploadValidator) offsetInRange(upload *Upload) error {
+	if upload.Offset < 0 || upload.Offset > upload.Size {
+		return ErrUploadOffsetInvalid
+	}
+	return nil
+}
+
+var _ UploadDB = &uploadGorm{}
+
+type uploadGorm struct {
+	db *gorm.DB
+}
+
+func (ug *uploadGorm) ByID(id uint) (*Upload, error) {
+	var upload Upload
+	err := first(ug.db.Where("id = ?", id), &upload)
+	if err == ErrResourceNotFound {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (ug *uploadGorm) Stale(before time.Time) ([]Upload, error) {
+	var uploads []Upload
+	err := ug.db.Where("updated_at < ?", before).Find(&uploads).Error
+	return uploads, err
+}
+
+func (ug *uploadGorm) Create(upload *Upload) error {
+	return ug.db.Create(upload).Error
+}
+
+func (ug *uploadGorm) Update(upload *Upload) error {
+	return ug.db.Save(upload).Error
+}
+
+func (ug *uploadGorm) Delete(id uint) error {
+	var upload Upload
+	upload.ID = id
+	return ug.db.Delete(&upload).Error
+}
@@ -3,7 +3,9 @@ package models
 import (
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/TerrenceHo/CalHacks4-Backend/hash"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"golang.org/x/crypto/bcrypt"
@@ -19,6 +21,23 @@ type User struct {
 	PasswordReset bool
 }
 
+// Roles a user can hold, stored in User.UserType.
+const (
+	RoleStudent   = "student"
+	RoleProfessor = "professor"
+	RoleTA        = "ta"
+	RoleAdmin     = "admin"
+)
+
+// ValidRole reports whether role is one of the roles defined above.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleStudent, RoleProfessor, RoleTA, RoleAdmin:
+		return true
+	}
+	return false
+}
+
 type UserDB interface {
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
@@ -30,15 +49,22 @@ type UserDB interface {
 
 type UserService interface {
 	Authenticate(email, password string) (*User, error)
+	// InitiateReset marks the user's password as being reset and returns a
+	// token to mail to them.
+	InitiateReset(email string) (string, error)
+	// CompleteReset sets a new password for the user the token was minted
+	// for.
+	CompleteReset(token, newPw string) (*User, error)
 	UserDB
 }
 
-func NewUserService(db *gorm.DB, pepper string) UserService {
+func NewUserService(db *gorm.DB, pepper string, resetSecret []byte) UserService {
 	ug := &userGorm{db}
 	uv := newUserValidator(ug, pepper)
 	return &userService{
-		UserDB: uv,
-		pepper: pepper,
+		UserDB:      uv,
+		pepper:      pepper,
+		resetSecret: hash.NewHMAC(string(resetSecret)),
 	}
 }
 
@@ -47,7 +73,8 @@ var _ UserService = &userService{}
 
 type userService struct {
 	UserDB
-	pepper string
+	pepper      string
+	resetSecret hash.HMAC
 }
 
 func (us *userService) Authenticate(email, password string) (*User, error) {
@@ -69,6 +96,55 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 	return foundUser, nil
 }
 
+func (us *userService) InitiateReset(email string) (string, error) {
+	user, err := us.ByEmail(email)
+	if err != nil {
+		return "", err
+	}
+	token, err := newResetToken(us.resetSecret, user, time.Now().Add(ResetTokenDuration))
+	if err != nil {
+		return "", err
+	}
+	user.PasswordReset = true
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (us *userService) CompleteReset(token, newPw string) (*User, error) {
+	id, expiresAt, err := parseResetToken(token)
+	if err != nil {
+		return nil, err
+	}
+	user, err := us.ByID(id)
+	if err != nil {
+		if err == ErrIDInvalid {
+			return nil, ErrResetTokenInvalid
+		}
+		return nil, err
+	}
+	if err := verifyResetToken(us.resetSecret, user, token); err != nil {
+		return nil, err
+	}
+	if !user.PasswordReset {
+		return nil, ErrResetTokenInvalid
+	}
+	if time.Now().After(expiresAt) {
+		return nil, ErrResetTokenExpired
+	}
+	if newPw == "" {
+		return nil, ErrPasswordRequired
+	}
+
+	user.Password = newPw
+	user.PasswordReset = false
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
 // call a func type
 // These functions that are of this type will run validation checks to on code
 // to make sure they all comply with safety
@@ -125,7 +201,10 @@ func (uv *userValidator) Create(user *User) error {
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.emailIsAvail,
+		uv.normalizeUserType,
+		uv.defaultUserType,
+		uv.userTypeValid)
 	if err != nil {
 		return err
 	}
@@ -140,7 +219,9 @@ func (uv *userValidator) Update(user *User) error {
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.emailIsAvail,
+		uv.normalizeUserType,
+		uv.userTypeValid)
 	if err != nil {
 		return err
 	}
@@ -222,6 +303,31 @@ func (uv *userValidator) emailIsAvail(user *User) error {
 	return nil
 }
 
+// Normalizes user types by removing spaces and making all lowercase
+func (uv *userValidator) normalizeUserType(user *User) error {
+	user.UserType = strings.ToLower(user.UserType)
+	user.UserType = strings.TrimSpace(user.UserType)
+	return nil
+}
+
+// Users who register without picking a role are students.
+func (uv *userValidator) defaultUserType(user *User) error {
+	if user.UserType == "" {
+		user.UserType = RoleStudent
+	}
+	return nil
+}
+
+func (uv *userValidator) userTypeValid(user *User) error {
+	if user.UserType == "" {
+		return nil
+	}
+	if !ValidRole(user.UserType) {
+		return ErrUserTypeInvalid
+	}
+	return nil
+}
+
 func (uv *userValidator) passwordMinLength(user *User) error {
 	if user.Password == "" {
 		return nil
@@ -279,9 +385,10 @@ func (ug *userGorm) Create(user *User) error {
 }
 
 // Update will update the provided user with all of the data
-// in the provided user object.
+// in the provided user object.  Save is used so that zero values, like
+// clearing PasswordReset, are written too.
 func (ug *userGorm) Update(user *User) error {
-	return ug.db.Model(user).Updates(user).Error
+	return ug.db.Save(user).Error
 }
 
 // Delete will delete the user with the provided ID
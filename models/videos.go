@@ -1,44 +1,566 @@
 package models
 
 import (
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TerrenceHo/CalHacks4-Backend/storage"
 	"github.com/jinzhu/gorm"
 	"github.com/lib/pq"
 )
 
+const (
+	// MaxTopicLength is the longest a topic or related resource can be,
+	// matching the varchar(200) columns they are stored in.
+	MaxTopicLength = 200
+	// MaxVideoTitleLength is the longest a lecture title can be.
+	MaxVideoTitleLength = 200
+	// MaxVideoDescriptionLength is the longest a lecture description can be.
+	MaxVideoDescriptionLength = 2000
+)
+
+// Video is a single recorded lecture.  Sequence is the lecture number within
+// its class and DurationSeconds is the length of the recording.  ObjectKey
+// names the recording in the configured storage backend; URL is where the
+// pipeline said it was, kept for recordings outside the store.  Status is
+// VideoStatusPending for uploads the pipeline has yet to process.
 type Video struct {
 	gorm.Model
 	ClassID           uint
 	URL               string
+	ObjectKey         string     `gorm:"type:text"`
+	Status            string     `gorm:"not null;default:'ready'"`
+	Title             string     `gorm:"size:200"`
+	Description       string     `gorm:"size:2000"`
+	Sequence          int        `gorm:"index"`
+	RecordedAt        *time.Time `gorm:"index"`
+	DurationSeconds   int
+	ThumbnailURL      string
 	Topics            pq.StringArray `gorm:"type:varchar(200)[]"`
 	Related_Resources pq.StringArray `gorm:"type:varchar(200)[]"`
 }
 
+// Statuses of a video.
+const (
+	VideoStatusPending = "pending"
+	VideoStatusReady   = "ready"
+)
+
+// Orders a class's videos can be listed in.
+const (
+	VideoOrderSequence = "sequence"
+	VideoOrderRecorded = "recorded"
+	VideoOrderCreated  = "created"
+)
+
+// How GetByKeywords combines several keywords.
+const (
+	// KeywordMatchAny finds videos with at least one of the keywords.
+	KeywordMatchAny = "any"
+	// KeywordMatchAll finds videos with every keyword.
+	KeywordMatchAll = "all"
+)
+
+// VideoListOptions filters and orders the videos of a class.  Zero values
+// mean no filter; the default order is by lecture number.
+type VideoListOptions struct {
+	OrderBy      string
+	Descending   bool
+	RecordedFrom *time.Time
+	RecordedTo   *time.Time
+	SequenceFrom int
+	SequenceTo   int
+}
+
 type VideoDB interface {
+	ByID(id uint) (*Video, error)
 	GetAll(id uint) ([]Video, error)
+	ByClass(classID uint, opts VideoListOptions) ([]Video, error)
+	// GetByKeywords finds the videos of a class whose topics match the
+	// keywords.  mode is KeywordMatchAny or KeywordMatchAll.  Matching
+	// ignores case and tolerates typos and partial words; videos matching
+	// the most keywords come first, then in lecture order.
+	GetByKeywords(classID uint, keywords []string, mode string) ([]KeywordMatch, error)
+	// SimilarTopics suggests known topics of a class close to term, closest
+	// first.
+	SimilarTopics(classID uint, term string, limit int) ([]TopicMatch, error)
+
 	Create(video *Video) error
-	GetByKeyword(id uint, keyword string) ([]Video, error)
+	Update(video *Video) error
+	Delete(id uint) error
 }
 
 type VideoService interface {
 	VideoDB
+	// Check runs the checks Create does on a video without saving it.
+	Check(video *Video) error
+	// AssignObjectKeys gives every video without an object key the key its
+	// URL points at in its class's part of the store, if any.
+	AssignObjectKeys() error
 }
 
-func NewVideoService(db *gorm.DB) VideoService {
+// NewVideoService returns a VideoService whose topic searches count a topic
+// as matching when its trigram similarity to a keyword is at least
+// similarity, between 0 and 1.  Zero means DefaultSimilarity.  Videos saved
+// with a URL into store get its object key when it is under their class's
+// storage.ClassPrefix in keyPrefix.
+func NewVideoService(db *gorm.DB, similarity float64, store storage.BlobStore, keyPrefix string) VideoService {
+	if similarity == 0 {
+		similarity = DefaultSimilarity
+	}
+	vg := &videoGorm{db, similarity}
+	vv := newVideoValidator(vg, &classGorm{db}, store, keyPrefix)
 	return &videoService{
-		VideoDB: &videoGorm{db},
+		VideoDB:   vv,
+		validator: vv,
+		db:        db,
+		store:     store,
+		keyPrefix: keyPrefix,
+		topics:    &classTopicGorm{db},
 	}
 }
 
+var _ VideoService = &videoService{}
+
+// videoService keeps the topic index of each class, and the resources of
+// each video, in step with its videos.
 type videoService struct {
 	VideoDB
+	validator *videoValidator
+	db        *gorm.DB
+	store     storage.BlobStore
+	keyPrefix string
+	topics    ClassTopicDB
+}
+
+func (vs *videoService) Check(video *Video) error {
+	return runVideoValFuncs(video, vs.validator.videoChecks()...)
 }
 
+// Create counts the new video's topics straight into the topic index and
+// carries over its Related_Resources, in the same transaction as the insert,
+// so a failure never leaves a video half saved.
+func (vs *videoService) Create(video *Video) error {
+	if err := vs.Check(video); err != nil {
+		return err
+	}
+	tx := vs.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := (&videoGorm{db: tx}).Create(video); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := (&classTopicGorm{tx}).AddVideo(video); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := NewResourceService(tx).ImportLegacy(video); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Update recounts the class's topics, since some may have been removed.  A
+// video moved to another class changes the topics of both.  The recount is
+// in the same transaction as the update.
+func (vs *videoService) Update(video *Video) error {
+	old, err := vs.ByID(video.ID)
+	if err != nil {
+		return err
+	}
+	fns := append([]videoValFunc{vs.validator.idGreaterThan(0)}, vs.validator.videoChecks()...)
+	if err := runVideoValFuncs(video, fns...); err != nil {
+		return err
+	}
+	tx := vs.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := (&videoGorm{db: tx}).Update(video); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if old.ClassID != video.ClassID {
+		if err := rebuildClassTopics(tx, old.ClassID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := rebuildClassTopics(tx, video.ClassID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := NewResourceService(tx).ImportLegacy(video); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (vs *videoService) Delete(id uint) error {
+	video, err := vs.ByID(id)
+	if err != nil {
+		return err
+	}
+	if err := vs.VideoDB.Delete(id); err != nil {
+		return err
+	}
+	return vs.topics.Rebuild(video.ClassID)
+}
+
+// AssignObjectKeys skips the validator and its hooks, so it can run on every
+// start without touching anything but the new column.
+func (vs *videoService) AssignObjectKeys() error {
+	if vs.store == nil {
+		return nil
+	}
+	videos := []Video{}
+	if err := vs.db.Where("coalesce(object_key, '') = '' AND url <> ''").Find(&videos).Error; err != nil {
+		return err
+	}
+	for _, video := range videos {
+		key, ok := vs.store.Key(video.URL)
+		if !ok || !strings.HasPrefix(key, storage.ClassPrefix(vs.keyPrefix, video.ClassID)) {
+			continue
+		}
+		err := vs.db.Model(&video).UpdateColumn("object_key", key).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type videoValFunc func(*Video) error
+
+func runVideoValFuncs(video *Video, fns ...videoValFunc) error {
+	for _, fn := range fns {
+		if err := fn(video); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ensures that videoValidator implements VideoDB interface
+var _ VideoDB = &videoValidator{}
+
+type videoValidator struct {
+	VideoDB
+	classes   ClassDB
+	store     storage.BlobStore
+	keyPrefix string
+}
+
+func newVideoValidator(vdb VideoDB, classes ClassDB, store storage.BlobStore, keyPrefix string) *videoValidator {
+	return &videoValidator{
+		VideoDB:   vdb,
+		classes:   classes,
+		store:     store,
+		keyPrefix: keyPrefix,
+	}
+}
+
+// videoChecks are the checks shared by Create and Update.
+func (vv *videoValidator) videoChecks() []videoValFunc {
+	return []videoValFunc{
+		vv.classExists,
+		vv.normalizeURL,
+		vv.urlScheme,
+		vv.setObjectKey,
+		vv.objectKeyValid,
+		vv.statusValid,
+		vv.normalizeTitle,
+		vv.titleMaxLength,
+		vv.descriptionMaxLength,
+		vv.sequenceNotNegative,
+		vv.durationNotNegative,
+		vv.thumbnailURLScheme,
+		vv.normalizeTopics,
+		vv.topicsMaxLength,
+		vv.normalizeResources,
+		vv.resourcesMaxLength,
+	}
+}
+
+func (vv *videoValidator) Create(video *Video) error {
+	if err := runVideoValFuncs(video, vv.videoChecks()...); err != nil {
+		return err
+	}
+	return vv.VideoDB.Create(video)
+}
+
+func (vv *videoValidator) Update(video *Video) error {
+	fns := append([]videoValFunc{vv.idGreaterThan(0)}, vv.videoChecks()...)
+	if err := runVideoValFuncs(video, fns...); err != nil {
+		return err
+	}
+	return vv.VideoDB.Update(video)
+}
+
+func (vv *videoValidator) Delete(id uint) error {
+	var video Video
+	video.ID = id
+	if err := runVideoValFuncs(&video, vv.idGreaterThan(0)); err != nil {
+		return err
+	}
+	return vv.VideoDB.Delete(id)
+}
+
+// GetByKeywords drops blank keywords and ones repeated in a different case.
+func (vv *videoValidator) GetByKeywords(classID uint, keywords []string, mode string) ([]KeywordMatch, error) {
+	keywords = dedupeStrings(keywords)
+	if len(keywords) == 0 {
+		return nil, ErrKeywordRequired
+	}
+	switch mode {
+	case "":
+		mode = KeywordMatchAny
+	case KeywordMatchAny, KeywordMatchAll:
+	default:
+		return nil, ErrKeywordModeInvalid
+	}
+	return vv.VideoDB.GetByKeywords(classID, keywords, mode)
+}
+
+func (vv *videoValidator) SimilarTopics(classID uint, term string, limit int) ([]TopicMatch, error) {
+	term = strings.TrimSpace(term)
+	if term == "" {
+		return nil, ErrKeywordRequired
+	}
+	if limit <= 0 {
+		limit = DefaultSimilarTopics
+	}
+	if limit > MaxSimilarTopics {
+		limit = MaxSimilarTopics
+	}
+	return vv.VideoDB.SimilarTopics(classID, term, limit)
+}
+
+func (vv *videoValidator) idGreaterThan(n uint) videoValFunc {
+	return videoValFunc(func(video *Video) error {
+		if video.ID <= n {
+			return ErrIDInvalid
+		}
+		return nil
+	})
+}
+
+func (vv *videoValidator) classExists(video *Video) error {
+	if video.ClassID == 0 {
+		return ErrClassIDRequired
+	}
+	_, err := vv.classes.GetClassByID(video.ClassID)
+	return err
+}
+
+func (vv *videoValidator) normalizeURL(video *Video) error {
+	video.URL = strings.TrimSpace(video.URL)
+	video.ObjectKey = strings.TrimSpace(video.ObjectKey)
+	return nil
+}
+
+// Videos either live in a storage bucket or are served over http(s).  Ones
+// uploaded straight to the store only have an object key.
+func (vv *videoValidator) urlScheme(video *Video) error {
+	if video.URL == "" {
+		if video.ObjectKey != "" {
+			return nil
+		}
+		return ErrVideoURLRequired
+	}
+	u, err := url.Parse(video.URL)
+	if err != nil || u.Host == "" {
+		return ErrVideoURLInvalid
+	}
+	switch u.Scheme {
+	case "gs", "s3", "https", "http":
+		return nil
+	}
+	return ErrVideoURLInvalid
+}
+
+// The URL, when there is one, decides the object key, so the two never
+// disagree.  URLs outside the class's part of the store have no key, and
+// are only ever given out as plain links.
+func (vv *videoValidator) setObjectKey(video *Video) error {
+	if vv.store == nil || video.URL == "" {
+		return nil
+	}
+	key, ok := vv.store.Key(video.URL)
+	if !ok || !strings.HasPrefix(key, storage.ClassPrefix(vv.keyPrefix, video.ClassID)) {
+		key = ""
+	}
+	video.ObjectKey = key
+	return nil
+}
+
+// Object keys given without a URL must name one of the class's objects, so
+// a video cannot be pointed at another class's recording
+func (vv *videoValidator) objectKeyValid(video *Video) error {
+	if video.ObjectKey == "" {
+		return nil
+	}
+	key, err := storage.CleanKey(video.ObjectKey)
+	if err != nil || !strings.HasPrefix(key, storage.ClassPrefix(vv.keyPrefix, video.ClassID)) {
+		return ErrVideoObjectKeyInvalid
+	}
+	video.ObjectKey = key
+	return nil
+}
+
+// Videos are ready unless said otherwise
+func (vv *videoValidator) statusValid(video *Video) error {
+	switch video.Status {
+	case "":
+		video.Status = VideoStatusReady
+	case VideoStatusPending, VideoStatusReady:
+	default:
+		return ErrVideoStatusInvalid
+	}
+	return nil
+}
+
+func (vv *videoValidator) normalizeTitle(video *Video) error {
+	video.Title = strings.TrimSpace(video.Title)
+	video.Description = strings.TrimSpace(video.Description)
+	return nil
+}
+
+func (vv *videoValidator) titleMaxLength(video *Video) error {
+	if utf8.RuneCountInString(video.Title) > MaxVideoTitleLength {
+		return ErrVideoTitleTooLong
+	}
+	return nil
+}
+
+func (vv *videoValidator) descriptionMaxLength(video *Video) error {
+	if utf8.RuneCountInString(video.Description) > MaxVideoDescriptionLength {
+		return ErrVideoDescriptionTooLong
+	}
+	return nil
+}
+
+func (vv *videoValidator) sequenceNotNegative(video *Video) error {
+	if video.Sequence < 0 {
+		return ErrVideoSequenceInvalid
+	}
+	return nil
+}
+
+func (vv *videoValidator) durationNotNegative(video *Video) error {
+	if video.DurationSeconds < 0 {
+		return ErrVideoDurationInvalid
+	}
+	return nil
+}
+
+// Thumbnails are optional, but when given must be links the app can load.
+// Like video URLs, ones into the store outside the class are only ever
+// given out as plain links
+func (vv *videoValidator) thumbnailURLScheme(video *Video) error {
+	video.ThumbnailURL = strings.TrimSpace(video.ThumbnailURL)
+	if video.ThumbnailURL == "" {
+		return nil
+	}
+	u, err := url.Parse(video.ThumbnailURL)
+	if err != nil || u.Host == "" {
+		return ErrThumbnailURLInvalid
+	}
+	switch u.Scheme {
+	case "gs", "s3", "https", "http":
+		return nil
+	}
+	return ErrThumbnailURLInvalid
+}
+
+func (vv *videoValidator) normalizeTopics(video *Video) error {
+	video.Topics = dedupeStrings(video.Topics)
+	return nil
+}
+
+func (vv *videoValidator) topicsMaxLength(video *Video) error {
+	for _, topic := range video.Topics {
+		if utf8.RuneCountInString(topic) > MaxTopicLength {
+			return ErrTopicTooLong
+		}
+	}
+	return nil
+}
+
+func (vv *videoValidator) normalizeResources(video *Video) error {
+	video.Related_Resources = dedupeStrings(video.Related_Resources)
+	return nil
+}
+
+func (vv *videoValidator) resourcesMaxLength(video *Video) error {
+	for _, resource := range video.Related_Resources {
+		if utf8.RuneCountInString(resource) > MaxTopicLength {
+			return ErrResourceTooLong
+		}
+	}
+	return nil
+}
+
+// dedupeStrings trims every string, drops empty ones and drops repeats that
+// only differ by case, keeping the first spelling seen.
+func dedupeStrings(in []string) []string {
+	out := make([]string, 0, len(in))
+	seen := map[string]bool{}
+	for _, s := range in {
+		s = strings.TrimSpace(s)
+		key := strings.ToLower(s)
+		if s == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+var _ VideoDB = &videoGorm{}
+
 type videoGorm struct {
-	db *gorm.DB
+	db         *gorm.DB
+	similarity float64
+}
+
+func (vg *videoGorm) ByID(id uint) (*Video, error) {
+	var video Video
+	err := first(vg.db.Where("id = ?", id), &video)
+	if err == ErrResourceNotFound {
+		return nil, ErrVideoNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &video, nil
 }
 
 func (vg *videoGorm) Create(video *Video) error {
-	return vg.db.Create(video).Error
+	if err := vg.db.Create(video).Error; err != nil {
+		return err
+	}
+	return refreshVideoSearch(vg.db, video.ID)
+}
+
+func (vg *videoGorm) Update(video *Video) error {
+	if err := vg.db.Save(video).Error; err != nil {
+		return err
+	}
+	return refreshVideoSearch(vg.db, video.ID)
+}
+
+func (vg *videoGorm) Delete(id uint) error {
+	var video Video
+	video.ID = id
+	return vg.db.Delete(&video).Error
 }
 
 func (vg *videoGorm) GetAll(id uint) ([]Video, error) {
@@ -49,11 +571,38 @@ func (vg *videoGorm) GetAll(id uint) ([]Video, error) {
 	return videos, nil
 }
 
-func (vg *videoGorm) GetByKeyword(id uint, keyword string) ([]Video, error) {
+func (vg *videoGorm) ByClass(classID uint, opts VideoListOptions) ([]Video, error) {
+	db := vg.db.Where("class_id = ?", classID)
+	if opts.RecordedFrom != nil {
+		db = db.Where("recorded_at >= ?", *opts.RecordedFrom)
+	}
+	if opts.RecordedTo != nil {
+		db = db.Where("recorded_at < ?", *opts.RecordedTo)
+	}
+	if opts.SequenceFrom > 0 {
+		db = db.Where("sequence >= ?", opts.SequenceFrom)
+	}
+	if opts.SequenceTo > 0 {
+		db = db.Where("sequence <= ?", opts.SequenceTo)
+	}
+
+	dir := "ASC"
+	if opts.Descending {
+		dir = "DESC"
+	}
+	switch opts.OrderBy {
+	case VideoOrderRecorded:
+		db = db.Order("recorded_at " + dir + " NULLS LAST").Order("id " + dir)
+	case VideoOrderCreated:
+		db = db.Order("created_at " + dir).Order("id " + dir)
+	case VideoOrderSequence, "":
+		db = db.Order("sequence " + dir).Order("recorded_at " + dir + " NULLS LAST").Order("id " + dir)
+	default:
+		return nil, ErrVideoOrderInvalid
+	}
+
 	videos := []Video{}
-	db := vg.db.Where("class_id = ?", id)
-	err := db.Where("? = ANY(topics)", keyword).Find(&videos).Error
-	if err != nil {
+	if err := db.Find(&videos).Error; err != nil {
 		return nil, err
 	}
 	return videos, nil
@@ -0,0 +1,37 @@
+package rand
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// TokenBytes is the number of random bytes used for tokens handed to clients.
+const TokenBytes = 32
+
+// Bytes will help us generate n random bytes, or will return an error if there
+// was one.  This uses the crypto/rand package so it is safe to use with things
+// like tokens.
+func Bytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// String will generate a byte slice of size nBytes and then return a string
+// that is the base64 URL encoded version of that byte slice
+func String(nBytes int) (string, error) {
+	b, err := Bytes(nBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// Token is a helper function designed to generate tokens of a predetermined
+// byte size.
+func Token() (string, error) {
+	return String(TokenBytes)
+}
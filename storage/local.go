@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local keeps objects as files under Dir.  BaseURL is where the server
+// serves those files from, such as "https://lectures.example.edu/media".
+// SigningKey signs the links handed out for them.
+type Local struct {
+	Dir        string
+	BaseURL    string
+	SigningKey []byte
+}
+
+var _ BlobStore = &Local{}
+
+// Key knows links under BaseURL and file:// paths under Dir.
+func (l *Local) Key(ref string) (string, bool) {
+	base := strings.TrimSuffix(l.BaseURL, "/") + "/"
+	if l.BaseURL != "" && strings.HasPrefix(ref, base) {
+		key, err := url.PathUnescape(strings.TrimPrefix(ref, base))
+		if err != nil {
+			return "", false
+		}
+		return cleanOK(key)
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	rel, err := filepath.Rel(l.Dir, u.Path)
+	if err != nil {
+		return "", false
+	}
+	return cleanOK(filepath.ToSlash(rel))
+}
+
+func (l *Local) URL(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(l.BaseURL, "/") + "/" + escapeKey(key), nil
+}
+
+// SignedURL adds the expiry and an HMAC of it and the key to the link, for
+// Verify to check when the link is followed.
+func (l *Local) SignedURL(key string, expires time.Time) (string, error) {
+	link, err := l.URL(key)
+	if err != nil {
+		return "", err
+	}
+	key, _ = CleanKey(key)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{}
+	q.Set("expires", exp)
+	q.Set("signature", l.sign(key, exp))
+	return link + "?" + q.Encode(), nil
+}
+
+// Verify checks the expires and signature query parameters of a link
+// made by SignedURL for key.
+func (l *Local) Verify(key string, q url.Values, now time.Time) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	exp := q.Get("expires")
+	sig, err := hex.DecodeString(q.Get("signature"))
+	if err != nil || exp == "" {
+		return ErrSignatureInvalid
+	}
+	want, _ := hex.DecodeString(l.sign(key, exp))
+	if !hmac.Equal(sig, want) {
+		return ErrSignatureInvalid
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	if now.After(time.Unix(unix, 0)) {
+		return ErrURLExpired
+	}
+	return nil
+}
+
+func (l *Local) sign(key, expires string) string {
+	return hex.EncodeToString(hmacSHA256(l.SigningKey, key+"\n"+expires))
+}
+
+// Put writes to a temporary file first so a failed upload never leaves half
+// an object behind.
+func (l *Local) Put(key string, r io.Reader, size int64, contentType string) error {
+	name, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (l *Local) Delete(key string) error {
+	name, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Open opens the file of the object at key for reading.
+func (l *Local) Open(key string) (*os.File, os.FileInfo, error) {
+	name, err := l.Path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, nil, ErrNotFound
+	}
+	return f, info, nil
+}
+
+// Path returns the file the object at key is kept in.
+func (l *Local) Path(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+func cleanOK(key string) (string, bool) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
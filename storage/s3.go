@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3 keeps objects in a bucket of Amazon S3 or any store that speaks its
+// API, such as MinIO.  Endpoint is the service's base URL, for example
+// "https://s3.us-west-2.amazonaws.com" or "http://localhost:9000".
+// PathStyle puts the bucket in the path rather than the host name, which
+// most self-hosted stores need.  Public says anyone can read the bucket, so
+// URL may give plain links; PublicURL, when set, is where they are read
+// from, such as a CDN, and makes the bucket public too.
+type S3 struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	Public    bool
+	PublicURL string
+
+	// Client is used to talk to the store, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+var _ BlobStore = &S3{}
+
+// Key knows s3://bucket/key references and links to objects in the bucket.
+func (s *S3) Key(ref string) (string, bool) {
+	if bucket, key, ok := bucketKey(ref, "s3"); ok {
+		if bucket != s.Bucket {
+			return "", false
+		}
+		return cleanOK(key)
+	}
+	for _, base := range []string{s.PublicURL, s.bucketURL()} {
+		if key, ok := keyUnder(ref, base); ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (s *S3) URL(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if s.PublicURL != "" {
+		return strings.TrimSuffix(s.PublicURL, "/") + "/" + escapeKey(key), nil
+	}
+	if !s.Public {
+		return "", ErrNotPublic
+	}
+	return s.bucketURL() + "/" + escapeKey(key), nil
+}
+
+// SignedURL presigns a link to the object.
+func (s *S3) SignedURL(key string, expires time.Time) (string, error) {
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return "", ErrNoCredentials
+	}
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(s.bucketURL() + "/" + escapeKey(key))
+	if err != nil {
+		return "", err
+	}
+	return s.signer().presign(u, time.Now(), expires), nil
+}
+
+func (s *S3) Put(key string, r io.Reader, size int64, contentType string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", s.bucketURL()+"/"+escapeKey(key), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return send(s.Client, s.signer(), req)
+}
+
+func (s *S3) Delete(key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", s.bucketURL()+"/"+escapeKey(key), nil)
+	if err != nil {
+		return err
+	}
+	return send(s.Client, s.signer(), req)
+}
+
+func (s *S3) signer() v4Signer {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return newAWSSigner(s.AccessKey, s.SecretKey, region)
+}
+
+// bucketURL is the base URL of the bucket's objects, without a trailing
+// slash.
+func (s *S3) bucketURL() string {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if s.PathStyle {
+		u.Path += "/" + url.PathEscape(s.Bucket)
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	return u.String()
+}
+
+// keyUnder returns the key of a link under base.
+func keyUnder(ref, base string) (string, bool) {
+	if base == "" {
+		return "", false
+	}
+	base = strings.TrimSuffix(base, "/") + "/"
+	if !strings.HasPrefix(ref, base) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(ref, base)
+	if i := strings.IndexAny(rest, "?#"); i >= 0 {
+		rest = rest[:i]
+	}
+	key, err := url.PathUnescape(rest)
+	if err != nil {
+		return "", false
+	}
+	return cleanOK(key)
+}
+
+// send signs req and sends it, turning error responses into errors.
+func send(client *http.Client, signer v4Signer, req *http.Request) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	signer.sign(req, unsignedPayload, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("storage: %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload lets a request body be streamed without hashing it first.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// v4Signer signs requests with AWS Signature Version 4.  Google Cloud
+// Storage's XML API takes the same scheme under different names, so one
+// signer serves both.
+type v4Signer struct {
+	accessKey string
+	secretKey string
+	region    string
+	service   string
+
+	algorithm    string // AWS4-HMAC-SHA256
+	keyPrefix    string // AWS4
+	terminator   string // aws4_request
+	headerPrefix string // x-amz-
+	queryPrefix  string // X-Amz-
+}
+
+func newAWSSigner(accessKey, secretKey, region string) v4Signer {
+	return v4Signer{
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		region:       region,
+		service:      "s3",
+		algorithm:    "AWS4-HMAC-SHA256",
+		keyPrefix:    "AWS4",
+		terminator:   "aws4_request",
+		headerPrefix: "x-amz-",
+		queryPrefix:  "X-Amz-",
+	}
+}
+
+func newGoogleSigner(accessKey, secretKey string) v4Signer {
+	return v4Signer{
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		region:       "auto",
+		service:      "storage",
+		algorithm:    "GOOG4-HMAC-SHA256",
+		keyPrefix:    "GOOG4",
+		terminator:   "goog4_request",
+		headerPrefix: "x-goog-",
+		queryPrefix:  "X-Goog-",
+	}
+}
+
+// sign adds the date, payload hash and Authorization headers to req.
+func (s v4Signer) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set(s.headerPrefix+"date", stamp)
+	req.Header.Set(s.headerPrefix+"content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || name == "content-md5" || strings.HasPrefix(name, s.headerPrefix) {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	req.URL.RawPath = canonicalPath(req.URL.Path)
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.RawPath,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := s.scope(day)
+	signature := s.signature(day, s.stringToSign(stamp, scope, canonical))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+// presign returns u with the query parameters that let anyone GET it until
+// expires.  Only the host header is signed, so any client can follow it.
+func (s v4Signer) presign(u *url.URL, now, expires time.Time) string {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	scope := s.scope(day)
+
+	signed := *u
+	signed.RawPath = canonicalPath(signed.Path)
+	q := signed.Query()
+	q.Set(s.queryPrefix+"Algorithm", s.algorithm)
+	q.Set(s.queryPrefix+"Credential", s.accessKey+"/"+scope)
+	q.Set(s.queryPrefix+"Date", stamp)
+	q.Set(s.queryPrefix+"Expires", strconv.FormatInt(int64(expires.Sub(now)/time.Second), 10))
+	q.Set(s.queryPrefix+"SignedHeaders", "host")
+
+	canonical := strings.Join([]string{
+		"GET",
+		signed.RawPath,
+		canonicalQuery(q),
+		"host:" + signed.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	signature := s.signature(day, s.stringToSign(stamp, scope, canonical))
+
+	signed.RawQuery = canonicalQuery(q) + "&" + s.queryPrefix + "Signature=" + signature
+	return signed.String()
+}
+
+func (s v4Signer) scope(day string) string {
+	return day + "/" + s.region + "/" + s.service + "/" + s.terminator
+}
+
+func (s v4Signer) stringToSign(stamp, scope, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	return s.algorithm + "\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+}
+
+func (s v4Signer) signature(day, stringToSign string) string {
+	key := hmacSHA256([]byte(s.keyPrefix+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, s.terminator)
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery sorts the query by name, then value, and encodes it the
+// strict way signature version 4 expects: spaces as %20, never +.
+func canonicalQuery(q map[string][]string) string {
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []string{}
+	for _, name := range names {
+		values := append([]string(nil), q[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// canonicalPath encodes each segment of a decoded URL path with uriEncode.
+// Go leaves characters like ":" and "+" alone in paths, but signature
+// version 4 wants them encoded, and so does the server checking it.
+func canonicalPath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// uriEncode percent encodes everything but unreserved characters.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+// Package storage keeps lecture media in a blob store and turns object keys
+// into links the app can play.  Keys are slash separated paths such as
+// "cs61a/lecture-01.mp4" and mean the same thing whichever store holds them.
+package storage
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrKeyInvalid is returned for keys that are empty, absolute or climb
+	// out of the store with "..".
+	ErrKeyInvalid = errors.New("storage: object key is invalid")
+	// ErrNotFound is returned when no object has the key.
+	ErrNotFound = errors.New("storage: object not found")
+	// ErrSignatureInvalid is returned when a signed URL was not signed by
+	// this store, or was changed since.
+	ErrSignatureInvalid = errors.New("storage: URL signature is invalid")
+	// ErrURLExpired is returned when a signed URL is past its expiry.
+	ErrURLExpired = errors.New("storage: URL has expired")
+	// ErrNoCredentials is returned by SignedURL when the store has no key to
+	// sign links with.  URL still gives the plain, unexpiring link.
+	ErrNoCredentials = errors.New("storage: no credentials to sign URLs with")
+	// ErrNotPublic is returned by URL when the store's objects cannot be
+	// read without a signed link.
+	ErrNotPublic = errors.New("storage: objects are not public")
+)
+
+// MaxSignedURLTTL is the longest a signed URL can last.  S3 and GCS refuse
+// to honour anything longer.
+const MaxSignedURLTTL = 7 * 24 * time.Hour
+
+// BlobStore is somewhere lecture media is kept.
+type BlobStore interface {
+	// Key returns the key of the object ref points at when ref is a link
+	// into this store, such as gs://bucket/key for GCS.
+	Key(ref string) (string, bool)
+	// URL returns a link the app can fetch the object from without signing,
+	// or ErrNotPublic if there is none.
+	URL(key string) (string, error)
+	// SignedURL returns a link to the object that stops working at expires,
+	// or ErrNoCredentials if the store cannot sign one.
+	SignedURL(key string, expires time.Time) (string, error)
+
+	// Put stores size bytes read from r under key.
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Delete(key string) error
+}
+
+// CleanKey checks a key and puts it in canonical form.
+func CleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return "", ErrKeyInvalid
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return "", ErrKeyInvalid
+		}
+	}
+	clean := path.Clean(key)
+	if clean == "." {
+		return "", ErrKeyInvalid
+	}
+	return clean, nil
+}
+
+// ClassPrefix is where the objects of a class live under prefix, such as
+// "uploads/class-12/": its uploaded recordings, renditions, thumbnails and
+// attachments.  Objects elsewhere in the store do not belong to the class.
+func ClassPrefix(prefix string, classID uint) string {
+	return path.Join(prefix, "class-"+strconv.FormatUint(uint64(classID), 10)) + "/"
+}
+
+// escapeKey percent encodes each segment of a key for use in a URL path, the
+// strict way signed requests need.
+func escapeKey(key string) string {
+	return canonicalPath(key)
+}
+
+// bucketKey splits a bucket reference like gs://bucket/key.
+func bucketKey(ref, scheme string) (bucket, key string, ok bool) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != scheme || u.Host == "" {
+		return "", "", false
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), true
+}